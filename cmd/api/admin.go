@@ -0,0 +1,174 @@
+// Filename: cmd/api/admin.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"forum.castillojadah.net/internals/data"
+	"forum.castillojadah.net/internals/validator"
+)
+
+// The readUserParam() method fetches the user whose id is in the URL. If it
+// returns nil the error response has already been sent
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) *data.User {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return user
+}
+
+// listPermissionsHandler for the "GET /v1/admin/permissions" endpoint
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Permissions.ListAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listUserPermissionsHandler for the "GET /v1/admin/users/:id/permissions" endpoint
+// shows a user's effective permissions and the roles they hold
+func (app *application) listUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	app.writeUserPermissions(w, r, user)
+}
+
+// grantUserPermissionHandler for the "PUT /v1/admin/users/:id/permissions/:code" endpoint
+func (app *application) grantUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermission(w, r, app.models.Permissions.GrantForUser)
+}
+
+// revokeUserPermissionHandler for the "DELETE /v1/admin/users/:id/permissions/:code" endpoint
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermission(w, r, app.models.Permissions.RemoveForUser)
+}
+
+// The changeUserPermission() method grants or revokes the permission in the URL
+// on behalf of the current user and responds with the user's new permissions
+func (app *application) changeUserPermission(w http.ResponseWriter, r *http.Request, change func(actorID, userID int64, code string) error) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	// Make sure the permission code exists
+	code := app.readCodeParam(r)
+	all, err := app.models.Permissions.ListAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if v.Check(all.Include(code), "code", "must be an existing permission code"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Apply and audit the change
+	err = change(app.contextGetUser(r).ID, user.ID, code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserPermissions(w, r, user)
+}
+
+// The writeUserPermissions() method responds with a user's effective
+// permissions and roles
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, user *data.User) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user_id": user.ID, "permissions": permissions, "roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listUserPermissionAuditHandler for the "GET /v1/admin/users/:id/permissions/audit"
+// endpoint shows who changed a user's permissions and when
+func (app *application) listUserPermissionAuditHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	audit, err := app.models.Permissions.GetAuditForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit": audit}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteUserHandler for the "DELETE /v1/admin/users/:id" endpoint anonymizes
+// an account straight away, without a grace period
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	err := app.anonymizeUser(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unlockUserHandler for the "DELETE /v1/admin/users/:id/lockout" endpoint
+// clears the failed logins of an account so its owner can log in again
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	err := app.models.LoginThrottles.Reset(data.LoginEmailKey(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,78 @@
+// Filename: cmd/api/admin_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+)
+
+func TestChangeRolePermission(t *testing.T) {
+	app := newTestApplication(t)
+	admin := newTestUser(t, app)
+	err := app.models.Permissions.AddForUser(admin.ID, "users:admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := app.models.Tokens.NewSession(admin.ID, time.Hour, time.Hour, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// forums:write only comes from the member role
+	member := newTestUser(t, app)
+	err = app.models.Roles.AddForUser(member.ID, "member")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := app.routes()
+
+	// The steps run in order, each one sees what the ones before it did
+	tests := []struct {
+		name       string
+		method     string
+		wantHas    bool
+		wantAudits int
+	}{
+		{"revoke", http.MethodDelete, false, 1},
+		{"revoke again", http.MethodDelete, false, 1},
+		{"grant", http.MethodPut, true, 2},
+		{"grant again", http.MethodPut, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, fmt.Sprintf("/v1/admin/users/%d/permissions/forums:write", member.ID), nil)
+			r.Header.Set("Authorization", "Bearer "+session.Plaintext)
+			routes.ServeHTTP(rr, r)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+			var response struct {
+				Permissions data.Permissions `json:"permissions"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := response.Permissions.Include("forums:write"); got != tt.wantHas {
+				t.Fatalf("got forums:write %t in the response; want %t", got, tt.wantHas)
+			}
+			if got := response.Permissions.Include("forums:read"); !got {
+				t.Fatal("forums:read went with forums:write")
+			}
+			audit, err := app.models.Permissions.GetAuditForUser(member.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(audit) != tt.wantAudits {
+				t.Fatalf("got %d audit entries; want %d", len(audit), tt.wantAudits)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Filename: cmd/api/apitokens.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+	"forum.castillojadah.net/internals/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// listAPITokensHandler for the "GET /v1/users/me/api-tokens" endpoint.
+// httprouter does not allow the route next to "GET /v1/users/:id", so it is
+// registered as "/v1/users/:id/api-tokens" and only answers for "me"
+func (app *application) listAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	if httprouter.ParamsFromContext(r.Context()).ByName("id") != "me" {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	tokens, err := app.models.APITokens.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_tokens": tokens}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createAPITokenHandler for the "POST /v1/users/me/api-tokens" endpoint. The
+// plaintext token is only shown in this response
+func (app *application) createAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Label       string     `json:"label"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := app.contextGetUser(r)
+	token := &data.APIToken{
+		UserID:      user.ID,
+		Label:       input.Label,
+		Permissions: input.Permissions,
+		Expiry:      input.Expiry,
+	}
+	// Perform validation
+	v := validator.New()
+	if data.ValidateAPIToken(v, token); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// A token can only be given permissions the user has
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(permissions.Intersect(token.Permissions)) != len(token.Permissions) {
+		v.AddError("permissions", "must only contain permissions you have")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.APITokens.Insert(token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAPITokenHandler for the "DELETE /v1/users/me/api-tokens/:id" endpoint
+func (app *application) deleteAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	err = app.models.APITokens.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "api token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,212 @@
+// Filename: cmd/api/categories.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"forum.castillojadah.net/internals/data"
+	"forum.castillojadah.net/internals/validator"
+)
+
+// listCategoriesHandler for the "GET /v1/categories" endpoint
+func (app *application) listCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	categories, err := app.models.Categories.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"categories": categories}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The categoryForSlug() method fetches the category named in the URL. If it
+// returns nil the error response has already been sent
+func (app *application) categoryForSlug(w http.ResponseWriter, r *http.Request) *data.Category {
+	category, err := app.models.Categories.GetBySlug(app.readSlugParam(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return category
+}
+
+// showCategoryHandler for the "GET /v1/categories/:slug" endpoint
+func (app *application) showCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	category := app.categoryForSlug(w, r)
+	if category == nil {
+		return
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"category": category}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listCategoryForumsHandler for the "GET /v1/categories/:slug/posts" endpoint
+// takes the same parameters as GET /v1/forum
+func (app *application) listCategoryForumsHandler(w http.ResponseWriter, r *http.Request) {
+	category := app.categoryForSlug(w, r)
+	if category == nil {
+		return
+	}
+	app.listForums(w, r, category)
+}
+
+// The saveCategory() method validates a category and writes it with save,
+// turning the errors about the slug and the parent into validation errors.
+// It reports whether the category was saved
+func (app *application) saveCategory(w http.ResponseWriter, r *http.Request, category *data.Category, save func(*data.Category) error) bool {
+	v := validator.New()
+	if data.ValidateCategory(v, category); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+	// Moving a category under one of its own subcategories would make a loop
+	if category.ParentID != nil && category.ID != 0 {
+		loop, err := app.models.Categories.IsDescendant(*category.ParentID, category.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+		if loop {
+			v.AddError("parent_id", "must not be one of the category's subcategories")
+			app.failedValidationResponse(w, r, v.Errors)
+			return false
+		}
+	}
+	err := save(category)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateSlug):
+			v.AddError("slug", "a category with this slug already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownCategory):
+			v.AddError("parent_id", "does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+	return true
+}
+
+// createCategoryHandler for the "POST /v1/categories" endpoint. The slug is
+// derived from the name when it is not given
+func (app *application) createCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string `json:"name"`
+		Slug        string `json:"slug"`
+		Description string `json:"description"`
+		Position    int    `json:"position"`
+		ParentID    int64  `json:"parent_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	category := &data.Category{
+		Name:        input.Name,
+		Slug:        input.Slug,
+		Description: input.Description,
+		Position:    input.Position,
+	}
+	if category.Slug == "" {
+		category.Slug = data.Slugify(input.Name)
+	}
+	if input.ParentID != 0 {
+		category.ParentID = &input.ParentID
+	}
+	if !app.saveCategory(w, r, category, app.models.Categories.Insert) {
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/categories/%s", category.Slug))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"category": category}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCategoryHandler for the "PATCH /v1/categories/:slug" endpoint
+func (app *application) updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	category := app.categoryForSlug(w, r)
+	if category == nil {
+		return
+	}
+	// If a field remains nil then we know that the client did not update it
+	var input struct {
+		Name        *string `json:"name"`
+		Slug        *string `json:"slug"`
+		Description *string `json:"description"`
+		Position    *int    `json:"position"`
+		ParentID    *int64  `json:"parent_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Name != nil {
+		category.Name = *input.Name
+	}
+	if input.Slug != nil {
+		category.Slug = *input.Slug
+	}
+	if input.Description != nil {
+		category.Description = *input.Description
+	}
+	if input.Position != nil {
+		category.Position = *input.Position
+	}
+	// A parent_id of zero moves the category to the top level
+	if input.ParentID != nil {
+		category.ParentID = input.ParentID
+		if *input.ParentID == 0 {
+			category.ParentID = nil
+		}
+	}
+	if !app.saveCategory(w, r, category, app.models.Categories.Update) {
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"category": category}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCategoryHandler for the "DELETE /v1/categories/:slug" endpoint. The
+// forums in the category are kept, without a category
+func (app *application) deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	category := app.categoryForSlug(w, r)
+	if category == nil {
+		return
+	}
+	err := app.models.Categories.Delete(category.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "category successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -10,27 +10,69 @@ import (
 	"forum.castillojadah.net/internals/validator"
 )
 
-// createCommentHandler for the "POST /v1/comment" endpoint
+// createCommentHandler for the "POST /v1/forum/:id/comments" endpoint
 func (app *application) createCommentHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the id of the forum the comment belongs to
+	postID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	// Make sure the forum exists before attaching a comment to it
+	_, err = app.models.Forums.Get(postID, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 	// Our target decode destination
 	var input struct {
+		ParentID int64  `json:"parent_id"`
 		Content  string `json:"content"`
 	}
 	// Initialize a new json.Decoder instance
-	err := app.readJSON(w, r, &input)
+	err = app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
 	// Copy the values from the input struct to a new Comment struct
+	// The authenticated user is the author of the comment
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	comment := &data.Comment{
+		PostID:   postID,
+		ParentID: input.ParentID,
+		UserID:   user.ID,
+		Author:   &data.Author{ID: user.ID, Username: user.Username},
 		Content:  input.Content,
 	}
 
 	// Initialize a new Validator instance
 	v := validator.New()
 
+	// A reply must point at an existing comment on the same forum
+	if comment.ParentID != 0 {
+		parent, err := app.models.Comments.Get(comment.ParentID, user.ID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("parent_id", "must be an existing comment")
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		default:
+			v.Check(parent.PostID == postID, "parent_id", "must be a comment on the same forum")
+		}
+	}
+
 	// Check the map to determine if there were any validation errors
 	if data.ValidateComment(v, comment); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
@@ -41,6 +83,7 @@ func (app *application) createCommentHandler(w http.ResponseWriter, r *http.Requ
 	err = app.models.Comments.Insert(comment)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 	// Create a Location header for the newly created resource/Comment
 	headers := make(http.Header)
@@ -62,7 +105,7 @@ func (app *application) showCommentHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Fetch the specific comment
-	comment, err := app.models.Comments.Get(id)
+	comment, err := app.models.Comments.Get(id, app.contextGetUser(r).ID)
 	// Handle errors
 	if err != nil {
 		switch {
@@ -89,7 +132,8 @@ func (app *application) updateCommentHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	// Fetch the orginal record from the database
-	comment, err := app.models.Comments.Get(id)
+	user := app.contextGetUser(r)
+	comment, err := app.models.Comments.Get(id, user.ID)
 	// Handle errors
 	if err != nil {
 		switch {
@@ -100,6 +144,16 @@ func (app *application) updateCommentHandler(w http.ResponseWriter, r *http.Requ
 		}
 		return
 	}
+	// Only the author or a moderator may edit the comment
+	ok, err := app.canModify(r, comment.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return
+	}
 
 	// Create an input struct to hold data read in from the client
 	// We update input struct to use pointers because pointers have a
@@ -156,6 +210,28 @@ func (app *application) deleteCommentHandler(w http.ResponseWriter, r *http.Requ
 		app.notFoundResponse(w, r)
 		return
 	}
+	// Fetch the record so we know who created it
+	user := app.contextGetUser(r)
+	comment, err := app.models.Comments.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Only the author or a moderator may delete the comment
+	ok, err := app.canModify(r, comment.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return
+	}
 	// Delete the Comment from the database. Send a 404 Not Found status code to the
 	// client if there is no matching record
 	err = app.models.Comments.Delete(id)
@@ -203,7 +279,7 @@ func (app *application) listCommentHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	// Get a listing of all comments
-	comments, metadata, err := app.models.Comments.GetAll(input.Content, input.Filters)
+	comments, metadata, err := app.models.Comments.GetAll(input.Content, app.contextGetUser(r).ID, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -215,4 +291,125 @@ func (app *application) listCommentHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-}
\ No newline at end of file
+}
+
+// The listForumCommentsHandler() allows the client to see the comments
+// that belong to a specific forum for the "GET /v1/forum/:id/comments" endpoint
+func (app *application) listForumCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the id of the forum
+	postID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	// Send a 404 if the forum does not exist rather than an empty listing
+	_, err = app.models.Forums.Get(postID, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Create an input struct to hold our query parameters
+	var input struct {
+		Content string
+		data.Filters
+	}
+	// Initialize a validator
+	v := validator.New()
+	// Get the URL values map
+	qs := r.URL.Query()
+	// Use the helper methods to extract the values
+	input.Content = app.readString(qs, "content", "")
+	// Get the page information
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Get the sort information
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	// Specific the allowed sort values
+	input.Filters.SortList = []string{"id", "content", "-id", "-content"}
+	// Check for validation errors
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Get a listing of the comments for the forum
+	comments, metadata, err := app.models.Comments.GetAllForPost(postID, input.Content, app.contextGetUser(r).ID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Send a JSON response containg the comments
+	err = app.writeJSON(w, http.StatusOK, envelope{"comments": comments, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showForumCommentTreeHandler() returns the comments of a forum as a tree
+// of replies for the "GET /v1/forum/:id/comments/tree" endpoint. Paging applies
+// to the top level, or to the replies of parent_id when it is given
+func (app *application) showForumCommentTreeHandler(w http.ResponseWriter, r *http.Request) {
+	// Get the id of the forum
+	postID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	// Send a 404 if the forum does not exist rather than an empty tree
+	_, err = app.models.Forums.Get(postID, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Create an input struct to hold our query parameters
+	var input struct {
+		ParentID int
+		MaxDepth int
+		Replies  int
+		data.Filters
+	}
+	// Initialize a validator
+	v := validator.New()
+	// Get the URL values map
+	qs := r.URL.Query()
+	// Use the helper methods to extract the values
+	input.ParentID = app.readInt(qs, "parent_id", 0, v)
+	input.MaxDepth = app.readInt(qs, "max_depth", 5, v)
+	input.Replies = app.readInt(qs, "replies", 10, v)
+	// Get the page information
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Threads are always in the order the comments were made
+	input.Filters.Sort = "id"
+	input.Filters.SortList = []string{"id"}
+	// Check for validation errors
+	v.Check(input.ParentID >= 0, "parent_id", "must not be negative")
+	v.Check(input.MaxDepth >= 0, "max_depth", "must not be negative")
+	v.Check(input.MaxDepth <= 20, "max_depth", "must be a maximum of 20")
+	v.Check(input.Replies > 0, "replies", "must be greater than zero")
+	v.Check(input.Replies <= 100, "replies", "must be a maximum of 100")
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Get the requested part of the thread
+	comments, metadata, err := app.models.Comments.GetTreeForPost(postID, int64(input.ParentID), app.contextGetUser(r).ID, input.MaxDepth, input.Replies, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Send a JSON response containg the comment tree
+	err = app.writeJSON(w, http.StatusOK, envelope{"comments": comments, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -15,6 +15,15 @@ type contextKey string
 // make user a key
 const userContextKey = contextKey("user")
 
+// make the hash of the session's access token a key
+const sessionContextKey = contextKey("session")
+
+// make the permissions of a personal access token a key
+const tokenScopesContextKey = contextKey("tokenScopes")
+
+// make the permissions carried by a signed access token a key
+const signedPermissionsContextKey = contextKey("signedPermissions")
+
 // Method to add user to the context
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -28,4 +37,43 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 		panic("missing user value in request context")
 	}
 	return user
-}
\ No newline at end of file
+}
+
+// Method to add the hash of the session's access token to the context
+func (app *application) contextSetSession(r *http.Request, tokenHash []byte) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, tokenHash)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the hash of the session's access token. Requests that were not
+// made within a login session have none
+func (app *application) contextGetSession(r *http.Request) []byte {
+	tokenHash, _ := r.Context().Value(sessionContextKey).([]byte)
+	return tokenHash
+}
+
+// Method to add the permissions a personal access token is limited to
+func (app *application) contextSetTokenScopes(r *http.Request, scopes data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenScopesContextKey, scopes)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the permissions the request is limited to. ok is false when the
+// request was not made with a personal access token
+func (app *application) contextGetTokenScopes(r *http.Request) (data.Permissions, bool) {
+	scopes, ok := r.Context().Value(tokenScopesContextKey).(data.Permissions)
+	return scopes, ok
+}
+
+// Method to add the permissions carried by a signed access token
+func (app *application) contextSetSignedPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), signedPermissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the permissions carried by a signed access token. ok is false when
+// the request was not made with one
+func (app *application) contextGetSignedPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(signedPermissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
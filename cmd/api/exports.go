@@ -0,0 +1,251 @@
+// Filename: cmd/api/exports.go
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+	"forum.castillojadah.net/internals/validator"
+)
+
+// createExportHandler for the "POST /v1/users/me/export" endpoint. The export
+// is queued and built by the "process exports" job
+func (app *application) createExportHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	queued, err := app.models.Exports.Insert(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	message := "your data export has been queued, an email will be sent when it is ready"
+	if !queued {
+		message = "your data export is already being prepared, an email will be sent when it is ready"
+	}
+	// Write a 202 Accepted Status
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// downloadExportHandler for the "GET /v1/exports/download" endpoint. The
+// token from the email is the only credential, so the link works as is
+func (app *application) downloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	tokenPlaintext := app.readString(r.URL.Query(), "token", "")
+	// Perform validation
+	v := validator.New()
+	if data.ValidateTokenPlainText(v, tokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user, err := app.models.Users.GetForToken(data.ScopeExport, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired export token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	export, err := app.models.Exports.GetLatestForUser(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	file, err := os.Open(export.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			app.notFoundResponse(w, r)
+			return
+		}
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer file.Close()
+	name := fmt.Sprintf("hifive-export-%s.zip", export.CreatedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, *export.CompletedAt, file)
+}
+
+// The processExports() method builds the queued exports one at a time until
+// there are none left. A failed export is marked so it is not retried forever
+func (app *application) processExports() error {
+	for {
+		export, err := app.models.Exports.Claim()
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		err = app.buildExport(export)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"export": strconv.FormatInt(export.ID, 10),
+			})
+			err = app.models.Exports.Fail(export.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		app.logger.PrintInfo("built data export", map[string]string{
+			"export": strconv.FormatInt(export.ID, 10),
+		})
+	}
+}
+
+// The buildExport() method writes a zip of JSON files with everything held
+// about the user and emails them a download token
+func (app *application) buildExport(export *data.Export) error {
+	user, err := app.models.Users.Get(export.UserID)
+	if err != nil {
+		return err
+	}
+	forums, err := app.models.Forums.GetAllByAuthor(user.ID)
+	if err != nil {
+		return err
+	}
+	comments, err := app.models.Comments.GetAllByAuthor(user.ID)
+	if err != nil {
+		return err
+	}
+	likes, err := app.models.Likes.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, nil)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name    string
+		content envelope
+	}{
+		{"profile.json", envelope{"user": user}},
+		{"forums.json", envelope{"forums": forums}},
+		{"comments.json", envelope{"comments": comments}},
+		{"likes.json", envelope{"likes": likes}},
+		{"permissions.json", envelope{"permissions": permissions, "roles": roles}},
+		{"sessions.json", envelope{"sessions": sessions}},
+	}
+
+	// Write to a temporary file first so a half written archive is never served
+	err = os.MkdirAll(app.config.exports.dir, 0700)
+	if err != nil {
+		return err
+	}
+	export.Path = filepath.Join(app.config.exports.dir, fmt.Sprintf("export-%d.zip", export.ID))
+	tmp, err := os.CreateTemp(app.config.exports.dir, "export-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	archive := zip.NewWriter(tmp)
+	for _, file := range files {
+		js, err := json.MarshalIndent(file.content, "", "\t")
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		fw, err := archive.Create(file.name)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		_, err = fw.Write(append(js, '\n'))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), export.Path)
+	if err != nil {
+		return err
+	}
+	err = app.models.Exports.Complete(export)
+	if err != nil {
+		// Nobody will ever download an archive without its export
+		if errors.Is(err, data.ErrRecordNotFound) {
+			os.Remove(export.Path)
+		}
+		return err
+	}
+
+	// Only the link to the latest export works
+	err = app.models.Tokens.DeleteAllForUsers(data.ScopeExport, user.ID)
+	if err != nil {
+		return err
+	}
+	token, err := app.models.Tokens.New(user.ID, app.config.exports.ttl, data.ScopeExport)
+	if err != nil {
+		return err
+	}
+	return app.mailer.Send(user.Email, "token_export.tmpl", map[string]interface{}{
+		"exportToken": token.Plaintext,
+		"expiresIn":   app.config.exports.ttl.String(),
+	})
+}
+
+// The purgeExports() method deletes the exports whose download token has
+// expired together with their archives
+func (app *application) purgeExports() error {
+	paths, err := app.models.Exports.DeleteFinishedBefore(time.Now().Add(-app.config.exports.ttl))
+	if err != nil {
+		return err
+	}
+	err = removeExportArchives(paths)
+	if err != nil {
+		return err
+	}
+	app.logger.PrintInfo("purged data exports", map[string]string{
+		"deleted": strconv.Itoa(len(paths)),
+	})
+	return nil
+}
+
+// The removeExportArchives() function deletes the archive files of exports
+// that no longer exist. Files that are already gone are not an error
+func removeExportArchives(paths []string) error {
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
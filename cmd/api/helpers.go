@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"forum.castillojadah.net/internals/data"
 	"forum.castillojadah.net/internals/validator"
 )
 
@@ -29,6 +30,18 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// The readCodeParam() method returns the permission code in the URL
+func (app *application) readCodeParam(r *http.Request) string {
+	params := httprouter.ParamsFromContext(r.Context())
+	return params.ByName("code")
+}
+
+// The readSlugParam() method returns the category slug in the URL
+func (app *application) readSlugParam(r *http.Request) string {
+	params := httprouter.ParamsFromContext(r.Context())
+	return params.ByName("slug")
+}
+
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	// Convert our map into a JSON object
 	js, err := json.MarshalIndent(data, "", "\t")
@@ -145,6 +158,51 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	}
 	return intValue
 }
+
+// The userPermissions() method returns the permissions of the authenticated
+// user. Requests made with a personal access token only get the permissions
+// that the token and the user have in common, and signed access tokens carry
+// the permissions the user had when the token was issued
+func (app *application) userPermissions(r *http.Request) (data.Permissions, error) {
+	if permissions, ok := app.contextGetSignedPermissions(r); ok {
+		return permissions, nil
+	}
+	user := app.contextGetUser(r)
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if scopes, ok := app.contextGetTokenScopes(r); ok {
+		permissions = permissions.Intersect(scopes)
+	}
+	return permissions, nil
+}
+
+// The currentUser() method returns the whole account of the authenticated
+// user. Signed access tokens only tell us the user's ID and activation state,
+// so handlers that need more read the account from the database
+func (app *application) currentUser(r *http.Request) (*data.User, error) {
+	user := app.contextGetUser(r)
+	if _, ok := app.contextGetSignedPermissions(r); !ok {
+		return user, nil
+	}
+	return app.models.Users.Get(user.ID)
+}
+
+// The canModify() method reports whether the authenticated user may edit or
+// delete a record. The owner always may, others need forums:moderate
+func (app *application) canModify(r *http.Request, ownerID int64) (bool, error) {
+	user := app.contextGetUser(r)
+	if ownerID != 0 && user.ID == ownerID {
+		return true, nil
+	}
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		return false, err
+	}
+	return permissions.Include("forums:moderate"), nil
+}
+
 // background accepts a function as its parameter
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter
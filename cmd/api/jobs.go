@@ -0,0 +1,134 @@
+// Filename: cmd/api/jobs.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+)
+
+// The schedule() method runs fn every interval in the background until the
+// server starts shutting down. Jobs are tracked by the WaitGroup so that
+// serve() waits for a run in progress to finish
+func (app *application) schedule(name string, interval time.Duration, fn func() error) {
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				app.runJob(name, fn)
+			case <-app.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// The runJob() method executes a single run of a job, logging its error and
+// recovering from panics so that one bad run does not stop the schedule
+func (app *application) runJob(name string, fn func() error) {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.PrintError(fmt.Errorf("%s", err), map[string]string{"job": name})
+		}
+	}()
+	err := fn()
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"job": name})
+	}
+}
+
+// The startJobs() method schedules the periodic maintenance jobs
+func (app *application) startJobs() {
+	if app.config.users.unactivatedTTL > 0 {
+		app.schedule("purge unactivated users", time.Hour, app.purgeUnactivatedUsers)
+	}
+	app.schedule("purge deleted users", time.Hour, app.purgeDeletedUsers)
+	app.schedule("cleanup login throttles", time.Hour, app.cleanupLoginThrottles)
+	if app.config.exports.pollInterval > 0 {
+		app.schedule("process exports", app.config.exports.pollInterval, app.processExports)
+	}
+	app.schedule("purge exports", time.Hour, app.purgeExports)
+	if app.config.tokens.cleanupInterval > 0 {
+		app.schedule("cleanup expired tokens", app.config.tokens.cleanupInterval, app.cleanupExpiredTokens)
+	}
+	if app.config.permissions.cacheTTL > 0 {
+		app.schedule("purge permission cache", app.config.permissions.cacheTTL, app.purgePermissionCache)
+	}
+}
+
+// The purgeUnactivatedUsers() method deletes accounts that were never
+// activated so that their email addresses can be registered again
+func (app *application) purgeUnactivatedUsers() error {
+	cutoff := time.Now().Add(-app.config.users.unactivatedTTL)
+	deleted, err := app.models.Users.DeleteUnactivatedBefore(cutoff)
+	if err != nil {
+		return err
+	}
+	app.logger.PrintInfo("purged unactivated users", map[string]string{
+		"deleted": strconv.FormatInt(deleted, 10),
+	})
+	return nil
+}
+
+// The purgeDeletedUsers() method anonymizes the accounts whose deletion grace
+// period is over
+func (app *application) purgeDeletedUsers() error {
+	cutoff := time.Now().Add(-app.config.users.deletionGrace)
+	ids, err := app.models.Users.GetDeletedBefore(cutoff)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = app.anonymizeUser(id)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			return err
+		}
+	}
+	app.logger.PrintInfo("purged deleted users", map[string]string{
+		"deleted": strconv.Itoa(len(ids)),
+	})
+	return nil
+}
+
+// The cleanupExpiredTokens() method deletes expired tokens in batches until
+// there are none left
+func (app *application) cleanupExpiredTokens() error {
+	var total, batches int64
+	for {
+		deleted, err := app.models.Tokens.DeleteExpired(app.config.tokens.cleanupBatchSize)
+		if err != nil {
+			return err
+		}
+		total += deleted
+		batches++
+		if deleted == 0 || deleted < int64(app.config.tokens.cleanupBatchSize) {
+			break
+		}
+	}
+	// Authorization codes that were never exchanged go too
+	codes, err := app.models.OAuthCodes.DeleteExpired()
+	if err != nil {
+		return err
+	}
+	app.logger.PrintInfo("cleaned up expired tokens", map[string]string{
+		"deleted": strconv.FormatInt(total, 10),
+		"codes":   strconv.FormatInt(codes, 10),
+		"batches": strconv.FormatInt(batches, 10),
+	})
+	return nil
+}
+
+// The purgePermissionCache() method drops the expired permission cache
+// entries of users who have not been seen since
+func (app *application) purgePermissionCache() error {
+	app.models.Permissions.Cache.Purge()
+	return nil
+}
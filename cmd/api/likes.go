@@ -0,0 +1,117 @@
+// Filename: cmd/api/likes.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"forum.castillojadah.net/internals/data"
+)
+
+// likeForumHandler for the "PUT /v1/forum/:id/like" endpoint
+func (app *application) likeForumHandler(w http.ResponseWriter, r *http.Request) {
+	app.setForumLike(w, r, app.models.Likes.LikePost)
+}
+
+// unlikeForumHandler for the "DELETE /v1/forum/:id/like" endpoint
+func (app *application) unlikeForumHandler(w http.ResponseWriter, r *http.Request) {
+	app.setForumLike(w, r, app.models.Likes.UnlikePost)
+}
+
+// likeCommentHandler for the "PUT /v1/comment/:id/like" endpoint
+func (app *application) likeCommentHandler(w http.ResponseWriter, r *http.Request) {
+	app.setCommentLike(w, r, app.models.Likes.LikeComment)
+}
+
+// unlikeCommentHandler for the "DELETE /v1/comment/:id/like" endpoint
+func (app *application) unlikeCommentHandler(w http.ResponseWriter, r *http.Request) {
+	app.setCommentLike(w, r, app.models.Likes.UnlikeComment)
+}
+
+// The setForumLike() method applies a like or unlike to the forum in the URL
+// and responds with the forum's updated like count. Both operations are
+// idempotent so clients can safely retry them
+func (app *application) setForumLike(w http.ResponseWriter, r *http.Request, apply func(userID, postID int64) error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	// Make sure the forum exists
+	_, err = app.models.Forums.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Like or unlike the forum
+	err = apply(user.ID, id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Fetch the forum again so the like count is up to date
+	forum, err := app.models.Forums.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"forum": forum}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The setCommentLike() method applies a like or unlike to the comment in the
+// URL and responds with the comment's updated like count
+func (app *application) setCommentLike(w http.ResponseWriter, r *http.Request, apply func(userID, commentID int64) error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	// Make sure the comment exists
+	_, err = app.models.Comments.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Like or unlike the comment
+	err = apply(user.ID, id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Fetch the comment again so the like count is up to date
+	comment, err := app.models.Comments.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"comment": comment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -4,7 +4,10 @@ package main
 import	(
 	"context"
 	"database/sql"
+	"errors"
+	"expvar"
 	"flag"
+	"fmt"
 	"os"
 	"strings"
 	"sync"
@@ -12,6 +15,7 @@ import	(
 	
 	"forum.castillojadah.net/internals/data"
 	"forum.castillojadah.net/internals/jsonlog"
+	"forum.castillojadah.net/internals/jwt"
 	"forum.castillojadah.net/internals/mailer"
 	_ "github.com/lib/pq"
 )
@@ -43,6 +47,36 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	users struct {
+		unactivatedTTL time.Duration
+		deletionGrace  time.Duration
+	}
+	permissions struct {
+		cacheTTL time.Duration
+	}
+	oauth struct {
+		tokenTTL time.Duration
+	}
+	login struct {
+		maxFailures   int
+		backoff       time.Duration
+		lockout       time.Duration
+		failureWindow time.Duration
+	}
+	exports struct {
+		dir          string
+		ttl          time.Duration
+		pollInterval time.Duration
+	}
+	tokens struct {
+		accessTTL        time.Duration
+		refreshTTL       time.Duration
+		cleanupInterval  time.Duration
+		cleanupBatchSize int
+		format           string
+		signingKeys      *jwt.Keys
+		signingKeyID     string
+	}
 }
 //Dependency Injection
 type application struct {
@@ -51,6 +85,8 @@ type application struct {
 	models data.Models
 	mailer mailer.Mailer
 	wg     sync.WaitGroup
+	shutdown chan struct{}
+	requiredPermissions []string
 }
 func main() {
 	var cfg config
@@ -77,9 +113,42 @@ func main() {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
+	// This is the flag for purging accounts that are never activated
+	flag.DurationVar(&cfg.users.unactivatedTTL, "users-unactivated-ttl", 7*24*time.Hour, "Delete accounts left unactivated for longer than this (0 disables)")
+	flag.DurationVar(&cfg.users.deletionGrace, "users-deletion-grace", 30*24*time.Hour, "How long a deleted account can be restored by logging in (0 deletes at once)")
+	// These are the flags for the lifetime of the login tokens
+	flag.DurationVar(&cfg.tokens.accessTTL, "tokens-access-ttl", 15*time.Minute, "Authentication token lifetime")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "tokens-refresh-ttl", 30*24*time.Hour, "Refresh token lifetime")
+	// These are the flags for issuing signed access tokens, which are checked
+	// without the database. Several keys can be given to rotate them
+	flag.StringVar(&cfg.tokens.format, "tokens-format", "opaque", "Authentication token format (opaque|signed)")
+	cfg.tokens.signingKeys = jwt.NewKeys()
+	flag.Func("tokens-signing-key", "Signed access token key as id:secret (repeatable)", cfg.tokens.signingKeys.Set)
+	flag.StringVar(&cfg.tokens.signingKeyID, "tokens-signing-key-id", "", "ID of the key new signed access tokens are signed with (defaults to the first key)")
+	// These are the flags for deleting expired tokens
+	flag.DurationVar(&cfg.tokens.cleanupInterval, "tokens-cleanup-interval", time.Hour, "How often expired tokens are deleted (0 disables)")
+	flag.IntVar(&cfg.tokens.cleanupBatchSize, "tokens-cleanup-batch-size", 1000, "Maximum expired tokens deleted per statement")
+	// These are the flags for personal data exports
+	flag.StringVar(&cfg.exports.dir, "exports-dir", "./exports", "Directory the data export archives are written to")
+	flag.DurationVar(&cfg.exports.ttl, "exports-ttl", 24*time.Hour, "How long a data export can be downloaded")
+	flag.DurationVar(&cfg.exports.pollInterval, "exports-poll-interval", 10*time.Second, "How often queued data exports are looked for (0 disables)")
+	// This is the flag for the tokens issued to OAuth clients
+	flag.DurationVar(&cfg.oauth.tokenTTL, "oauth-token-ttl", time.Hour, "How long access tokens issued to OAuth clients last")
+	// These are the flags for slowing down password guessing
+	flag.IntVar(&cfg.login.maxFailures, "login-max-failures", 10, "Failed logins in a row before an account is locked out")
+	flag.DurationVar(&cfg.login.backoff, "login-backoff", time.Second, "Wait after the first failed login, doubled after each one")
+	flag.DurationVar(&cfg.login.lockout, "login-lockout", 15*time.Minute, "How long an account stays locked out")
+	flag.DurationVar(&cfg.login.failureWindow, "login-failure-window", 24*time.Hour, "How long a failed login counts towards a lockout")
+	// This is the flag for caching user permissions in memory
+	flag.DurationVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", time.Minute, "How long user permissions are cached (0 disables)")
 	flag.Parse()
 	// Create a logger
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	// Make sure signed access tokens can be issued before going any further
+	err := checkTokenConfig(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 	//Create the database connection
 	db, err := openDB(cfg)
 	if err != nil{
@@ -92,15 +161,55 @@ func main() {
 	app := &application {
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
+		models: data.NewModels(db, cfg.permissions.cacheTTL),
 		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		shutdown: make(chan struct{}),
  	} 
+	// Publish the permission cache hit and miss counts on /debug/vars
+	expvar.Publish("permission_cache", expvar.Func(func() interface{} {
+		return app.models.Permissions.Cache.Stats()
+	}))
+	// Run a one-off maintenance command instead of the server if one is given,
+	// for example: api -db-dsn=... cleanup-tokens
+	switch flag.Arg(0) {
+	case "":
+	case "cleanup-tokens":
+		err = app.cleanupExpiredTokens()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		return
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown command %q", flag.Arg(0)), nil)
+	}
+	// Start the periodic maintenance jobs
+	app.startJobs()
 	// Call app.serve() to start the server
 	err = app.serve()
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 }	
+// The checkTokenConfig() function validates the token format flags
+func checkTokenConfig(cfg config) error {
+	if cfg.tokens.signingKeyID != "" {
+		err := cfg.tokens.signingKeys.SetSigningKey(cfg.tokens.signingKeyID)
+		if err != nil {
+			return err
+		}
+	}
+	switch cfg.tokens.format {
+	case "opaque":
+	case "signed":
+		if cfg.tokens.signingKeys.Len() == 0 {
+			return errors.New("signed tokens need at least one -tokens-signing-key")
+		}
+	default:
+		return fmt.Errorf("unknown token format %q", cfg.tokens.format)
+	}
+	return nil
+}
+
 //The openDB() function returns a *sql.db connection pool
 func openDB(cfg config) (*sql.DB, error){
 	db, err := sql.Open("postgres", cfg.db.dsn)
@@ -3,6 +3,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
@@ -12,6 +14,7 @@ import (
 	"time"
 
 	"forum.castillojadah.net/internals/data"
+	"forum.castillojadah.net/internals/jwt"
 	"forum.castillojadah.net/internals/validator"
 	"golang.org/x/time/rate"
 )
@@ -108,6 +111,21 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 		// Extract the token
 		token := headerParts[1]
+		// Signed access tokens are verified without the database
+		if jwt.IsJWT(token) {
+			app.authenticateSignedToken(w, r, token, next)
+			return
+		}
+		// Personal access tokens live in their own table
+		if data.IsAPIToken(token) {
+			app.authenticateAPIToken(w, r, token, next)
+			return
+		}
+		// OAuth access tokens are limited to the scopes the user consented to
+		if data.IsOAuthToken(token) {
+			app.authenticateOAuthToken(w, r, token, next)
+			return
+		}
 		// Validate the token
 		v := validator.New()
 		if data.ValidateTokenPlainText(v, token); !v.Valid() {
@@ -126,13 +144,121 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			}
 			return
 		}
+		// Record when the session was last used
+		err = app.models.Tokens.Touch(token)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		// Add the user information to the request context
 		r = app.contextSetUser(r, user)
+		tokenHash := sha256.Sum256([]byte(token))
+		r = app.contextSetSession(r, tokenHash[:])
 		// Call the next handler in the chain
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The authenticateSignedToken() method is the part of authenticate that deals
+// with signed access tokens. The user is built from the token's claims alone,
+// so the user in the context only has its ID and activation state, and the
+// permissions in the token are used instead of the database's
+func (app *application) authenticateSignedToken(w http.ResponseWriter, r *http.Request, token string, next http.Handler) {
+	claims, err := app.config.tokens.signingKeys.Verify(token, time.Now())
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	sessionHash, err := base64.RawURLEncoding.DecodeString(claims.SessionID)
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	user := &data.User{ID: claims.Subject, Activated: claims.Activated}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetSession(r, sessionHash)
+	r = app.contextSetSignedPermissions(r, data.Permissions(claims.Permissions))
+	next.ServeHTTP(w, r)
+}
+
+// The authenticateAPIToken() method is the part of authenticate that deals
+// with personal access tokens. The token's permissions are kept in the
+// context so that requirePermission only allows what both the token and
+// the user have
+func (app *application) authenticateAPIToken(w http.ResponseWriter, r *http.Request, tokenPlaintext string, next http.Handler) {
+	v := validator.New()
+	if data.ValidateAPITokenPlaintext(v, tokenPlaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	token, err := app.models.APITokens.GetForPlaintext(tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Deleted accounts cannot be used while they wait to be purged
+	if user.DeletedAt != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	err = app.models.APITokens.Touch(token.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetTokenScopes(r, token.Permissions)
+	next.ServeHTTP(w, r)
+}
+
+// The authenticateOAuthToken() method is the part of authenticate that deals
+// with access tokens issued to OAuth clients. Like personal access tokens
+// their scopes are kept in the context for requirePermission
+func (app *application) authenticateOAuthToken(w http.ResponseWriter, r *http.Request, tokenPlaintext string, next http.Handler) {
+	if len(tokenPlaintext) != len(data.OAuthTokenPrefix)+26 {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	token, err := app.models.Tokens.GetOAuth(tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Deleted accounts cannot be used while they wait to be purged
+	if user.DeletedAt != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	err = app.models.Tokens.Touch(tokenPlaintext)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetTokenScopes(r, token.Permissions)
+	next.ServeHTTP(w, r)
+}
+
 // Check for activated user
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -162,11 +288,12 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 }
 
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	// Remember the code so it can be checked against the database on startup
+	app.requiredPermissions = append(app.requiredPermissions, code)
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// get the user
-		user := app.contextGetUser(r)
-		// get the permission slice for the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// get the permission slice for the user, limited to the scopes
+		// of the personal access token if one was used
+		permissions, err := app.userPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -182,6 +309,48 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 
 	return app.requireActivatedUser(fn)
 }
+// The requireSession() middleware turns away personal access tokens and OAuth
+// access tokens, so that a token cannot be used to manage the account, its
+// sessions, tokens or clients and widen its own reach. Their scopes only
+// ever cover the routes behind requirePermission()
+func (app *application) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return app.requireActivatedUser(app.rejectScopedTokens(next))
+}
+
+// The requireAuthenticatedSession() middleware is requireSession() for the
+// routes that accounts which are not activated yet may use too
+func (app *application) requireAuthenticatedSession(next http.HandlerFunc) http.HandlerFunc {
+	return app.requireAuthenticatedUser(app.rejectScopedTokens(next))
+}
+
+// The rejectScopedTokens() middleware refuses requests made with a token that
+// is limited to scopes
+func (app *application) rejectScopedTokens(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := app.contextGetTokenScopes(r); ok {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// The checkPermissionCodes() method makes sure that every permission code the
+// routes require exists, so a mistyped code stops the server from starting
+// instead of locking every user out of the route
+func (app *application) checkPermissionCodes() error {
+	// forums:moderate is checked inside the handlers rather than by a route
+	codes := append([]string{"forums:moderate"}, app.requiredPermissions...)
+	missing, err := app.models.Permissions.Missing(codes...)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("unknown permission codes required by routes: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 // Enable CORS
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,142 @@
+// Filename: cmd/api/middleware_test.go
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+)
+
+// authenticateAs() runs a request with the bearer token through authenticate
+// and returns the status and the ID of the user the handler saw
+func authenticateAs(app *application, token string) (int, int64) {
+	var userID int64
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID = app.contextGetUser(r).ID
+	})
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	app.authenticate(next).ServeHTTP(rr, r)
+	return rr.Code, userID
+}
+
+func TestAuthenticateOpaqueToken(t *testing.T) {
+	app := newTestApplication(t)
+	user := newTestUser(t, app)
+
+	access, _, err := app.models.Tokens.NewSession(user.ID, time.Hour, time.Hour, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &data.OAuthClient{
+		UserID:       user.ID,
+		Name:         "test",
+		RedirectURIs: []string{"https://example.com/callback"},
+		Scopes:       data.Permissions{"forums:read"},
+	}
+	err = app.models.OAuthClients.Insert(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oauth, err := app.models.Tokens.NewOAuth(user.ID, client.ID, client.Scopes, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+		wantUserID int64
+	}{
+		{"session token", access.Plaintext, http.StatusOK, user.ID},
+		{"oauth token", oauth.Plaintext, http.StatusOK, user.ID},
+		{"unknown session token", "AAAAAAAAAAAAAAAAAAAAAAAAAA", http.StatusUnauthorized, 0},
+		{"unknown oauth token", data.OAuthTokenPrefix + "AAAAAAAAAAAAAAAAAAAAAAAAAA", http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The second request makes sure touching a used token works too
+			for i := 0; i < 2; i++ {
+				status, userID := authenticateAs(app, tt.token)
+				if status != tt.wantStatus {
+					t.Fatalf("got status %d; want %d", status, tt.wantStatus)
+				}
+				if userID != tt.wantUserID {
+					t.Fatalf("got user %d; want %d", userID, tt.wantUserID)
+				}
+			}
+		})
+	}
+}
+
+func TestScopedTokensOnAccountRoutes(t *testing.T) {
+	app := newTestApplication(t)
+	user := newTestUser(t, app)
+
+	pat := &data.APIToken{
+		UserID:      user.ID,
+		Label:       "test",
+		Permissions: data.Permissions{"forums:read"},
+	}
+	err := app.models.APITokens.Insert(pat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The consent given to a client is the upper bound of its tokens too
+	client := &data.OAuthClient{
+		UserID:       user.ID,
+		Name:         "test",
+		RedirectURIs: []string{"https://example.com/callback"},
+		Scopes:       data.Permissions{"forums:read"},
+	}
+	err = app.models.OAuthClients.Insert(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oauth, err := app.models.Tokens.NewOAuth(user.ID, client.ID, client.Scopes, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := map[string]string{
+		"personal access token": pat.Plaintext,
+		"oauth token":           oauth.Plaintext,
+	}
+	routes := app.routes()
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/v1/users/me"},
+		{http.MethodPatch, "/v1/users/me"},
+		{http.MethodDelete, "/v1/users/me"},
+		{http.MethodPut, "/v1/users/me/email"},
+		{http.MethodPost, "/v1/users/me/2fa"},
+		{http.MethodPut, "/v1/users/me/2fa/confirmed"},
+		{http.MethodDelete, "/v1/users/me/2fa"},
+		{http.MethodPost, "/v1/users/me/export"},
+		{http.MethodGet, "/v1/tokens/authentication"},
+		{http.MethodDelete, "/v1/tokens/authentication"},
+		{http.MethodDelete, "/v1/tokens/authentication/all"},
+	}
+	for name, token := range tokens {
+		for _, tt := range tests {
+			t.Run(name+" "+tt.method+" "+tt.path, func(t *testing.T) {
+				rr := httptest.NewRecorder()
+				r := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+				r.Header.Set("Authorization", "Bearer "+token)
+				routes.ServeHTTP(rr, r)
+				if rr.Code != http.StatusForbidden {
+					t.Fatalf("got status %d; want %d", rr.Code, http.StatusForbidden)
+				}
+			})
+		}
+	}
+}
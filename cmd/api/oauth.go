@@ -0,0 +1,363 @@
+// Filename: cmd/api/oauth.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+	"forum.castillojadah.net/internals/validator"
+)
+
+// How long an authorization code can wait before it is exchanged
+const oauthCodeTTL = 10 * time.Minute
+
+// The authorizationRequest type holds the parameters of an authorization
+// code request (RFC 6749 section 4.1.1 with the PKCE parameters of RFC 7636)
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// The oauthErrorResponse() method sends an error in the format OAuth clients
+// expect: an error code and a human readable description
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	headers := make(http.Header)
+	if status == http.StatusUnauthorized {
+		headers.Set("WWW-Authenticate", "Basic")
+	}
+	err := app.writeJSON(w, status, envelope{"error": code, "error_description": description}, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// registerOAuthClientHandler for the "POST /v1/oauth/clients" endpoint. The
+// client secret of confidential clients is only shown in this response
+func (app *application) registerOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := app.contextGetUser(r)
+	client := &data.OAuthClient{
+		UserID:       user.ID,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		Confidential: input.Confidential,
+	}
+	// Perform validation
+	v := validator.New()
+	if data.ValidateOAuthClient(v, client); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	codes, err := app.models.Permissions.ListAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(codes.Intersect(client.Scopes)) != len(client.Scopes) {
+		v.AddError("scopes", "must only contain known permissions")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.OAuthClients.Insert(client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"client": client}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listOAuthClientsHandler for the "GET /v1/oauth/clients" endpoint
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	clients, err := app.models.OAuthClients.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteOAuthClientHandler for the "DELETE /v1/oauth/clients/:id" endpoint.
+// Every token issued to the client goes with it
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	err = app.models.OAuthClients.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "client successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The checkAuthorizationRequest() method validates an authorization request
+// and returns the client and the requested scopes. If the client is nil the
+// error response has already been sent
+func (app *application) checkAuthorizationRequest(w http.ResponseWriter, r *http.Request, req *authorizationRequest) (*data.OAuthClient, data.Permissions) {
+	client, err := app.models.OAuthClients.GetByClientID(req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "unknown client_id")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, nil
+	}
+	// The redirect URI may only be left out when there is a single one
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !client.HasRedirectURI(req.RedirectURI) {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "redirect_uri is not registered for the client")
+		return nil, nil
+	}
+	if req.ResponseType != "code" {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_response_type", "only the code response type is supported")
+		return nil, nil
+	}
+	// PKCE is required of every client, with the S256 method
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "a code_challenge with the S256 method is required")
+		return nil, nil
+	}
+	scopes := data.Permissions(strings.Fields(req.Scope))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	if len(client.Scopes.Intersect(scopes)) != len(scopes) || !validator.Unique(scopes) {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the scope must be a subset of the client's scopes")
+		return nil, nil
+	}
+	return client, scopes
+}
+
+// showAuthorizationHandler for the "GET /v1/oauth/authorize" endpoint. The
+// frontend calls it with the query string the client sent the user to it
+// with, and shows the returned details on its consent page
+func (app *application) showAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	req := &authorizationRequest{
+		ResponseType:        qs.Get("response_type"),
+		ClientID:            qs.Get("client_id"),
+		RedirectURI:         qs.Get("redirect_uri"),
+		Scope:               qs.Get("scope"),
+		State:               qs.Get("state"),
+		CodeChallenge:       qs.Get("code_challenge"),
+		CodeChallengeMethod: qs.Get("code_challenge_method"),
+	}
+	client, scopes := app.checkAuthorizationRequest(w, r, req)
+	if client == nil {
+		return
+	}
+	env := envelope{
+		"client":       envelope{"client_id": client.ClientID, "name": client.Name},
+		"scopes":       scopes,
+		"redirect_uri": req.RedirectURI,
+	}
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createAuthorizationHandler for the "POST /v1/oauth/authorize" endpoint
+// records the user's decision on the consent page. The response holds the
+// URI to send the user back to the client with, carrying either the
+// authorization code or an access_denied error
+func (app *application) createAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	client, scopes := app.checkAuthorizationRequest(w, r, &input.authorizationRequest)
+	if client == nil {
+		return
+	}
+	redirect, err := url.Parse(input.RedirectURI)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	params := redirect.Query()
+	if input.State != "" {
+		params.Set("state", input.State)
+	}
+	if !input.Approve {
+		params.Set("error", "access_denied")
+	} else {
+		user := app.contextGetUser(r)
+		code := &data.OAuthCode{
+			ClientID:      client.ID,
+			UserID:        user.ID,
+			RedirectURI:   input.RedirectURI,
+			Scopes:        scopes,
+			CodeChallenge: input.CodeChallenge,
+		}
+		err = app.models.OAuthCodes.New(code, oauthCodeTTL)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		params.Set("code", code.Plaintext)
+	}
+	redirect.RawQuery = params.Encode()
+	err = app.writeJSON(w, http.StatusOK, envelope{"redirect_uri": redirect.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The authenticateOAuthClient() method reads the form of a token or revocation
+// request and identifies the client, by HTTP basic auth or by the client_id
+// and client_secret fields. If it returns nil the response has been sent
+func (app *application) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) *data.OAuthClient {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the body must be a url encoded form")
+		return nil
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client, err := app.models.OAuthClients.GetByClientID(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "unknown client")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	if client.Confidential && !client.SecretMatches(secret) {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+		return nil
+	}
+	return client
+}
+
+// createOAuthTokenHandler for the "POST /v1/oauth/token" endpoint exchanges
+// an authorization code and its PKCE verifier for an access token
+func (app *application) createOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	client := app.authenticateOAuthClient(w, r)
+	if client == nil {
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "only the authorization_code grant is supported")
+		return
+	}
+	code, err := app.models.OAuthCodes.Consume(r.PostForm.Get("code"), client.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != code.RedirectURI {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	}
+	if !data.VerifyCodeChallenge(code.CodeChallenge, r.PostForm.Get("code_verifier")) {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid code_verifier")
+		return
+	}
+	// The user may have been deactivated or deleted since they consented
+	user, err := app.models.Users.Get(code.UserID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if user == nil || !user.Activated || user.DeletedAt != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the user can no longer be authorized")
+		return
+	}
+	token, err := app.models.Tokens.NewOAuth(user.ID, client.ID, code.Scopes, app.config.oauth.tokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	headers.Set("Pragma", "no-cache")
+	env := envelope{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(app.config.oauth.tokenTTL.Seconds()),
+		"scope":        strings.Join(code.Scopes, " "),
+	}
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeOAuthTokenHandler for the "POST /v1/oauth/revoke" endpoint. As RFC
+// 7009 asks, unknown tokens are not an error
+func (app *application) revokeOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	client := app.authenticateOAuthClient(w, r)
+	if client == nil {
+		return
+	}
+	err := app.models.Tokens.DeleteOAuth(r.PostForm.Get("token"), client.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "token revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,195 @@
+// Filename: cmd/api/oauth_test.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The oauthTestClient type plays both the forum frontend, with the user's
+// session, and the third-party client, with its credentials
+type oauthTestClient struct {
+	t       *testing.T
+	api     string
+	session string
+	id      string
+	secret  string
+}
+
+// The do() method sends a JSON request to the API, checks the status and
+// decodes the response into dst
+func (c *oauthTestClient) do(method, path, token string, body, dst interface{}, wantStatus int) {
+	c.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, c.api+path, &buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	c.send(req, dst, wantStatus)
+}
+
+// The postForm() method sends a token or revocation request the way an
+// OAuth client does, authenticating with its credentials
+func (c *oauthTestClient) postForm(path string, form url.Values, dst interface{}, wantStatus int) {
+	c.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, c.api+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.id, c.secret)
+	c.send(req, dst, wantStatus)
+}
+
+func (c *oauthTestClient) send(req *http.Request, dst interface{}, wantStatus int) {
+	c.t.Helper()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	js, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if res.StatusCode != wantStatus {
+		c.t.Fatalf("%s %s: got status %d; want %d: %s", req.Method, req.URL.Path, res.StatusCode, wantStatus, js)
+	}
+	if dst != nil {
+		err = json.Unmarshal(js, dst)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// The authorize() method approves or denies an authorization request on the
+// user's behalf and returns the parameters the client is sent back with
+func (c *oauthTestClient) authorize(params url.Values, approve bool) url.Values {
+	c.t.Helper()
+	c.do(http.MethodGet, "/v1/oauth/authorize?"+params.Encode(), c.session, nil, nil, http.StatusOK)
+	approval := map[string]interface{}{"approve": approve}
+	for key := range params {
+		approval[key] = params.Get(key)
+	}
+	var decision struct {
+		RedirectURI string `json:"redirect_uri"`
+	}
+	c.do(http.MethodPost, "/v1/oauth/authorize", c.session, approval, &decision, http.StatusOK)
+	redirect, err := url.Parse(decision.RedirectURI)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return redirect.Query()
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	app := newTestApplication(t)
+	user := newTestUser(t, app)
+	err := app.models.Permissions.AddForUser(user.ID, "forums:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := app.models.Tokens.NewSession(user.ID, time.Hour, time.Hour, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+	c := &oauthTestClient{t: t, api: srv.URL, session: session.Plaintext}
+
+	// Register a confidential client
+	redirectURI := "http://localhost:8080/callback"
+	var registered struct {
+		Client struct {
+			ID           int64  `json:"id"`
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+		} `json:"client"`
+	}
+	c.do(http.MethodPost, "/v1/oauth/clients", c.session, map[string]interface{}{
+		"name":          "test",
+		"redirect_uris": []string{redirectURI},
+		"scopes":        []string{"forums:read"},
+		"confidential":  true,
+	}, &registered, http.StatusCreated)
+	c.id = registered.Client.ClientID
+	c.secret = registered.Client.ClientSecret
+	defer c.do(http.MethodDelete, fmt.Sprintf("/v1/oauth/clients/%d", registered.Client.ID), c.session, nil, nil, http.StatusOK)
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.id},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"forums:read"},
+		"state":                 {"test-state"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	// A denied request sends the user back without a code
+	denied := c.authorize(params, false)
+	if denied.Get("error") != "access_denied" || denied.Get("code") != "" || denied.Get("state") != "test-state" {
+		t.Fatalf("got %v; want an access_denied error", denied)
+	}
+
+	// A wrong verifier burns the code
+	approved := c.authorize(params, true)
+	if approved.Get("state") != "test-state" {
+		t.Fatalf("got state %q; want %q", approved.Get("state"), "test-state")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {approved.Get("code")},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {strings.Repeat("w", 43)},
+	}
+	c.postForm("/v1/oauth/token", form, nil, http.StatusBadRequest)
+	form.Set("code_verifier", verifier)
+	c.postForm("/v1/oauth/token", form, nil, http.StatusBadRequest)
+
+	// The right verifier gets a token, once
+	approved = c.authorize(params, true)
+	form.Set("code", approved.Get("code"))
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		Scope       string `json:"scope"`
+	}
+	c.postForm("/v1/oauth/token", form, &token, http.StatusOK)
+	if token.TokenType != "Bearer" || token.Scope != "forums:read" {
+		t.Fatalf("got %+v; want a bearer token for forums:read", token)
+	}
+	c.postForm("/v1/oauth/token", form, nil, http.StatusBadRequest)
+
+	// The token works within its scopes only
+	c.do(http.MethodGet, "/v1/forum", token.AccessToken, nil, nil, http.StatusOK)
+	c.do(http.MethodPost, "/v1/forum", token.AccessToken, map[string]string{}, nil, http.StatusForbidden)
+	c.do(http.MethodGet, "/v1/tokens/authentication", token.AccessToken, nil, nil, http.StatusForbidden)
+
+	// And stops working once revoked
+	c.postForm("/v1/oauth/revoke", url.Values{"token": {token.AccessToken}}, nil, http.StatusOK)
+	c.do(http.MethodGet, "/v1/forum", token.AccessToken, nil, nil, http.StatusUnauthorized)
+}
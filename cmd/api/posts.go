@@ -16,6 +16,8 @@ func (app *application) createForumHandler(w http.ResponseWriter, r *http.Reques
 	var input struct {
 		Title     string `json:"title"`
 		Content  string `json:"content"`
+		CategoryID int64 `json:"category_id"`
+		Tags     []string `json:"tags"`
 	}
 	// Initialize a new json.Decoder instance
 	err := app.readJSON(w, r, &input)
@@ -24,10 +26,22 @@ func (app *application) createForumHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// The authenticated user is the author of the forum
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	// Copy the values from the input struct to a new Forum struct
 	forum := &data.Forum{
+		UserID:   user.ID,
+		Author:   &data.Author{ID: user.ID, Username: user.Username},
 		Title:     input.Title,
 		Content:  input.Content,
+		Tags:     data.NormalizeTags(input.Tags),
+	}
+	if input.CategoryID != 0 {
+		forum.CategoryID = &input.CategoryID
 	}
 
 	// Initialize a new Validator instance
@@ -42,7 +56,14 @@ func (app *application) createForumHandler(w http.ResponseWriter, r *http.Reques
 	// Create a Forum
 	err = app.models.Forums.Insert(forum)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrUnknownCategory):
+			v.AddError("category_id", "does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 	// Create a Location header for the newly created resource/Forum
 	headers := make(http.Header)
@@ -64,7 +85,7 @@ func (app *application) showForumHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Fetch the specific forum
-	forum, err := app.models.Forums.Get(id)
+	forum, err := app.models.Forums.Get(id, app.contextGetUser(r).ID)
 	// Handle errors
 	if err != nil {
 		switch {
@@ -91,7 +112,8 @@ func (app *application) updateForumHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	// Fetch the orginal record from the database
-	forum, err := app.models.Forums.Get(id)
+	user := app.contextGetUser(r)
+	forum, err := app.models.Forums.Get(id, user.ID)
 	// Handle errors
 	if err != nil {
 		switch {
@@ -102,6 +124,16 @@ func (app *application) updateForumHandler(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
+	// Only the author or a moderator may edit the forum
+	ok, err := app.canModify(r, forum.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return
+	}
 
 	// Create an input struct to hold data read in from the client
 	// We update input struct to use pointers because pointers have a
@@ -110,6 +142,8 @@ func (app *application) updateForumHandler(w http.ResponseWriter, r *http.Reques
 	var input struct {
 		Title     *string `json:"title"`
 		Content  *string `json:"content"`
+		CategoryID *int64 `json:"category_id"`
+		Tags     []string `json:"tags"`
 	}
 
 	// Initialize a new json.Decoder instance
@@ -126,6 +160,17 @@ func (app *application) updateForumHandler(w http.ResponseWriter, r *http.Reques
 	if input.Content != nil {
 		forum.Content = *input.Content
 	}
+	// The tags given replace all of the forum's tags
+	if input.Tags != nil {
+		forum.Tags = data.NormalizeTags(input.Tags)
+	}
+	// A category_id of zero takes the forum out of its category
+	if input.CategoryID != nil {
+		forum.CategoryID = input.CategoryID
+		if *input.CategoryID == 0 {
+			forum.CategoryID = nil
+		}
+	}
 	
 	// Perform validation on the updated Forum. If validation fails, then
 	// we send a 422 - Unprocessable Entity respose to the client
@@ -143,6 +188,9 @@ func (app *application) updateForumHandler(w http.ResponseWriter, r *http.Reques
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrUnknownCategory):
+			v.AddError("category_id", "does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -162,6 +210,28 @@ func (app *application) deleteForumHandler(w http.ResponseWriter, r *http.Reques
 		app.notFoundResponse(w, r)
 		return
 	}
+	// Fetch the record so we know who created it
+	user := app.contextGetUser(r)
+	forum, err := app.models.Forums.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Only the author or a moderator may delete the forum
+	ok, err := app.canModify(r, forum.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return
+	}
 	// Delete the Forum from the database. Send a 404 Not Found status code to the
 	// client if there is no matching record
 	err = app.models.Forums.Delete(id)
@@ -185,10 +255,20 @@ func (app *application) deleteForumHandler(w http.ResponseWriter, r *http.Reques
 // The listForumHandler() allows the client to see a listing of forums
 // based on a set of criteria
 func (app *application) listForumHandler(w http.ResponseWriter, r *http.Request) {
+	app.listForums(w, r, nil)
+}
+
+// The listForums() method reads the search, sort and pagination parameters
+// of a forum listing and sends the matching forums. When category is not nil
+// only its forums are listed and the category is sent along with them
+func (app *application) listForums(w http.ResponseWriter, r *http.Request, category *data.Category) {
 	// Create an input struct to hold our query parameters
 	var input struct {
 		Title     string
 		Content string
+		Period  string
+		Tags    []string
+		TagsMode string
 		data.Filters
 	}
 	// Initialize a validator
@@ -204,20 +284,36 @@ func (app *application) listForumHandler(w http.ResponseWriter, r *http.Request)
 	// Get the sort information
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	// Specific the allowed sort values
-	input.Filters.SortList = []string{"id", "title", "content", "-id", "-title", "-content"}
+	input.Filters.SortList = []string{"id", "title", "content", "-id", "-title", "-content", "hot", "top", "active", "new"}
+	// Get how far back the listing should reach
+	input.Period = app.readString(qs, "t", "all")
+	// Get the tags to filter by and whether any or all of them must match
+	input.Tags = data.NormalizeTags(app.readCSV(qs, "tags", []string{}))
+	input.TagsMode = app.readString(qs, "tags_mode", "any")
 	// Check for validation errors
+	v.Check(validator.In(input.Period, "day", "week", "month", "all"), "t", "must be one of day, week, month or all")
+	v.Check(validator.In(input.TagsMode, "any", "all"), "tags_mode", "must be either any or all")
+	data.ValidateTags(v, input.Tags)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	env := envelope{}
+	var categoryID int64
+	if category != nil {
+		categoryID = category.ID
+		env["category"] = category
+	}
 	// Get a listing of all forums
-	forums, metadata, err := app.models.Forums.GetAll(input.Title, input.Content, input.Filters)
+	forums, metadata, err := app.models.Forums.GetAll(input.Title, input.Content, input.Period, categoryID, input.Tags, input.TagsMode == "all", app.contextGetUser(r).ID, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	env["forums"] = forums
+	env["metadata"] = metadata
 	// Send a JSON response containg all the forums
-	err = app.writeJSON(w, http.StatusOK, envelope{"forums": forums, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -13,18 +14,69 @@ func (app *application) routes() http.Handler {
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/forum", app.requirePermission("forums::write", app.createForumHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/forum", app.requirePermission("forums:write", app.createForumHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/forum", app.requirePermission("forums:read", app.listForumHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/forum/:id", app.requirePermission("forums:read", app.showForumHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/forum/:id", app.requirePermission("forums::write", app.updateForumHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/forum/:id", app.requirePermission("forums::write", app.deleteForumHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/comment", app.requirePermission("forums::write", app.createCommentHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/forum/:id", app.requirePermission("forums:write", app.updateForumHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/forum/:id", app.requirePermission("forums:write", app.deleteForumHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/forum/:id/like", app.requirePermission("forums:read", app.likeForumHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/forum/:id/like", app.requirePermission("forums:read", app.unlikeForumHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/forum/:id/comments", app.requirePermission("forums:read", app.listForumCommentsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/forum/:id/comments/tree", app.requirePermission("forums:read", app.showForumCommentTreeHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/forum/:id/comments", app.requirePermission("forums:write", app.createCommentHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/categories", app.requirePermission("forums:read", app.listCategoriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/categories", app.requirePermission("users:admin", app.createCategoryHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/categories/:slug", app.requirePermission("forums:read", app.showCategoryHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/categories/:slug", app.requirePermission("users:admin", app.updateCategoryHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/categories/:slug", app.requirePermission("users:admin", app.deleteCategoryHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/categories/:slug/posts", app.requirePermission("forums:read", app.listCategoryForumsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/tags", app.requirePermission("forums:read", app.listTagsHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/comment", app.requirePermission("forums:read", app.listCommentHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/comment/:id", app.requirePermission("forums:read", app.showCommentHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/comment/:id", app.requirePermission("forums::write", app.updateCommentHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/comment/:id", app.requirePermission("forums::write", app.deleteCommentHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/comment/:id", app.requirePermission("forums:write", app.updateCommentHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/comment/:id", app.requirePermission("forums:write", app.deleteCommentHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/comment/:id/like", app.requirePermission("forums:read", app.likeCommentHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/comment/:id/like", app.requirePermission("forums:read", app.unlikeCommentHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id", app.showUserHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireSession(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticatedSession(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/email", app.requireSession(app.updateCurrentUserEmailHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/email/confirmed", app.confirmUserEmailHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa", app.requireSession(app.enrollTwoFactorHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/2fa/confirmed", app.requireSession(app.confirmTwoFactorHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/2fa", app.requireSession(app.disableTwoFactorHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/api-tokens", app.requireSession(app.listAPITokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-tokens", app.requireSession(app.createAPITokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-tokens/:id", app.requireSession(app.deleteAPITokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/export", app.requireSession(app.createExportHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/exports/download", app.downloadExportHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/tokens/authentication", app.requireAuthenticatedSession(app.listAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedSession(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedSession(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link/exchange", app.exchangeMagicLinkTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/2fa", app.createTwoFactorAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.createRefreshedTokensHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/clients", app.requireSession(app.listOAuthClientsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/clients", app.requireSession(app.registerOAuthClientHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/oauth/clients/:id", app.requireSession(app.deleteOAuthClientHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/authorize", app.requireSession(app.showAuthorizationHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/authorize", app.requireSession(app.createAuthorizationHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/token", app.createOAuthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/revoke", app.revokeOAuthTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("users:admin", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.listUserPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions/audit", app.requirePermission("users:admin", app.listUserPermissionAuditHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:admin", app.grantUserPermissionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:admin", app.revokeUserPermissionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id", app.requirePermission("users:admin", app.deleteUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lockout", app.requirePermission("users:admin", app.unlockUserHandler))
+	router.Handler(http.MethodGet, "/debug/vars", app.requirePermission("users:admin", expvar.Handler().ServeHTTP))
 	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
 }
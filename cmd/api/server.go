@@ -15,10 +15,16 @@ import (
 )
 
 func (app *application) serve() error {
+	// Build the routes and check the permissions they require
+	handler := app.routes()
+	err := app.checkPermissionCodes()
+	if err != nil {
+		return err
+	}
 	// Create our HTTP server
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
-		Handler:      app.routes(),
+		Handler:      handler,
 		ErrorLog:     log.New(app.logger, "", 0),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
@@ -42,8 +48,20 @@ func (app *application) serve() error {
 		// Create a context with a 20-second timeout
 		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
+		// Stop the scheduled jobs from starting new runs
+		close(app.shutdown)
 		// Call the Shutdown() function
-		shutdownError <- srv.Shutdown(ctx)
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			shutdownError <- err
+			return
+		}
+		// Wait for the background tasks and jobs to complete
+		app.logger.PrintInfo("completing background tasks", map[string]string{
+			"addr": srv.Addr,
+		})
+		app.wg.Wait()
+		shutdownError <- nil
 	}()
 
 	// Start our server
@@ -53,7 +71,7 @@ func (app *application) serve() error {
 	})
 
 	// Check if the shutdown process has been initiated
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -0,0 +1,41 @@
+// Filename: cmd/api/tags.go
+
+package main
+
+import (
+	"net/http"
+
+	"forum.castillojadah.net/internals/data"
+	"forum.castillojadah.net/internals/validator"
+)
+
+// listTagsHandler for the "GET /v1/tags" endpoint lists the tags in use with
+// how many forums use them. The q parameter only keeps the tags starting
+// with it, for autocompletion
+func (app *application) listTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Prefix string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Prefix = data.NormalizeTag(app.readString(qs, "q", ""))
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-count")
+	input.Filters.SortList = []string{"count", "name", "-count", "-name"}
+	v.Check(input.Prefix == "" || validator.Matches(input.Prefix, data.TagRX), "q", "must only contain letters, digits and the characters - + # .")
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	tags, metadata, err := app.models.Tags.GetAll(input.Prefix, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"tags": tags, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
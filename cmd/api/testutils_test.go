@@ -0,0 +1,72 @@
+// Filename: cmd/api/testutils_test.go
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+	"forum.castillojadah.net/internals/jsonlog"
+	"forum.castillojadah.net/internals/jwt"
+	_ "github.com/lib/pq"
+)
+
+// newTestApplication() returns an application backed by the database in
+// FORUM_TEST_DB_DSN, which must have every migration applied. Tests that
+// need it are skipped when the variable is not set
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+	dsn := os.Getenv("FORUM_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("FORUM_TEST_DB_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg config
+	cfg.tokens.accessTTL = 15 * time.Minute
+	cfg.tokens.refreshTTL = time.Hour
+	cfg.tokens.format = "opaque"
+	cfg.tokens.signingKeys = jwt.NewKeys()
+	cfg.oauth.tokenTTL = time.Hour
+	return &application{
+		config:   cfg,
+		logger:   jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models:   data.NewModels(db, 0),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// newTestUser() inserts an activated user that is deleted again when the
+// test ends
+func newTestUser(t *testing.T, app *application) *data.User {
+	t.Helper()
+	user := &data.User{
+		Username:  fmt.Sprintf("test%d", time.Now().UnixNano()),
+		Activated: true,
+	}
+	user.Email = user.Username + "@example.com"
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		app.models.Users.DB.Exec(`DELETE FROM users WHERE id = $1`, user.ID)
+	})
+	return user
+}
@@ -0,0 +1,135 @@
+// Filename: cmd/api/throttle.go
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+)
+
+// The clientIP() method returns the address the request came from
+func (app *application) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// The reserveLoginAttempt() method counts a login attempt against the keys
+// before the credentials are checked, so that concurrent attempts cannot get
+// past the backoff. The attempt is refused while any of the keys is backing
+// off or locked out, in which case ok is false and the response has been
+// sent. Otherwise the number of failures of the first key, counting this
+// attempt, is returned. A successful attempt is handed back with
+// releaseLoginAttempt(), a failed one reported with recordLoginFailure()
+func (app *application) reserveLoginAttempt(w http.ResponseWriter, r *http.Request, keys ...string) (int, bool) {
+	since := time.Now().Add(-app.config.login.failureWindow)
+	failures, until, err := app.models.LoginThrottles.Reserve(keys, since, app.loginBackoff)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return 0, false
+	}
+	if !until.IsZero() {
+		app.tooManyLoginAttemptsResponse(w, r, until)
+		return 0, false
+	}
+	return failures[keys[0]], true
+}
+
+// The releaseLoginAttempt() method takes back the attempt reserved for keys
+// once the credentials turned out to be right
+func (app *application) releaseLoginAttempt(keys ...string) error {
+	return app.models.LoginThrottles.Release(keys...)
+}
+
+// The recordLoginFailure() method handles a failed login whose attempt was
+// already counted by reserveLoginAttempt(). When it was the attempt that
+// reached the limit the account is locked out and its owner, if there is
+// one, gets an email about it
+func (app *application) recordLoginFailure(failures int, user *data.User) {
+	if failures != app.config.login.maxFailures {
+		return
+	}
+	properties := map[string]string{
+		"failures": strconv.Itoa(failures),
+	}
+	if user != nil {
+		properties["user_id"] = strconv.FormatInt(user.ID, 10)
+	}
+	app.logger.PrintInfo("account locked out", properties)
+	if user == nil {
+		return
+	}
+	app.background(func() {
+		data := map[string]interface{}{
+			"lockout": app.config.login.lockout.String(),
+		}
+		err := app.mailer.Send(user.Email, "account_locked.tmpl", data)
+		if err != nil {
+			// log errors
+			app.logger.PrintError(err, nil)
+		}
+	})
+}
+
+// The checkPassword() method checks the password of a signed in user before
+// a sensitive change. It goes through the same throttle as logins so that a
+// stolen session cannot be used to guess the password. If it returns false
+// the response has been sent
+func (app *application) checkPassword(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	keys := []string{data.LoginEmailKey(user.Email), data.LoginIPKey(app.clientIP(r))}
+	failures, ok := app.reserveLoginAttempt(w, r, keys...)
+	if !ok {
+		return false
+	}
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !match {
+		app.recordLoginFailure(failures, user)
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+	err = app.releaseLoginAttempt(keys...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	return true
+}
+
+// The loginBackoff() method returns how long to wait after a number of failed
+// logins in a row. The wait doubles with every failure up to the lockout
+func (app *application) loginBackoff(failures int) time.Duration {
+	if failures >= app.config.login.maxFailures {
+		return app.config.login.lockout
+	}
+	backoff := app.config.login.backoff
+	for i := 1; i < failures && backoff < app.config.login.lockout; i++ {
+		backoff *= 2
+	}
+	if backoff > app.config.login.lockout {
+		return app.config.login.lockout
+	}
+	return backoff
+}
+
+// The cleanupLoginThrottles() method forgets the failed logins that are too
+// old to count
+func (app *application) cleanupLoginThrottles() error {
+	deleted, err := app.models.LoginThrottles.DeleteStale(time.Now().Add(-app.config.login.failureWindow))
+	if err != nil {
+		return err
+	}
+	app.logger.PrintInfo("cleaned up login throttles", map[string]string{
+		"deleted": strconv.FormatInt(deleted, 10),
+	})
+	return nil
+}
@@ -0,0 +1,49 @@
+// Filename: cmd/api/throttle_test.go
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+)
+
+func TestCheckPasswordThrottle(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.login.maxFailures = 5
+	app.config.login.backoff = time.Minute
+	app.config.login.lockout = time.Hour
+	app.config.login.failureWindow = time.Hour
+	user := newTestUser(t, app)
+
+	// Requests made with httptest all come from the same documentation address
+	keys := []string{data.LoginEmailKey(user.Email), data.LoginIPKey("192.0.2.1")}
+	t.Cleanup(func() { app.models.LoginThrottles.Reset(keys...) })
+
+	// The steps run in order, each one sees what the ones before it did
+	tests := []struct {
+		name       string
+		password   string
+		wantStatus int
+	}{
+		{"wrong password", "wrong-password", http.StatusUnauthorized},
+		{"backing off", "wrong-password", http.StatusTooManyRequests},
+		{"right password while backing off", "pa55word1234", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			body := strings.NewReader(`{"password": "` + tt.password + `"}`)
+			r := httptest.NewRequest(http.MethodPost, "/v1/users/me/2fa", body)
+			r = app.contextSetUser(r, user)
+			app.enrollTwoFactorHandler(rr, r)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+		})
+	}
+}
@@ -2,11 +2,13 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"net/http"
 	"time"
 
 	"forum.castillojadah.net/internals/data"
+	"forum.castillojadah.net/internals/jwt"
 	"forum.castillojadah.net/internals/validator"
 )
 
@@ -29,12 +31,23 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	// Count the attempt up front, refusing it while the account or the client
+	// is backing off
+	emailKey := data.LoginEmailKey(input.Email)
+	keys := []string{emailKey, data.LoginIPKey(app.clientIP(r))}
+	failures, ok := app.reserveLoginAttempt(w, r, keys...)
+	if !ok {
+		return
+	}
 	// Get the user details based on the provided email
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r) // implement this later
+			// Take as long as a real password check would
+			data.CompareDummyPassword(input.Password)
+			app.recordLoginFailure(failures, nil)
+			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -48,19 +61,462 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 	// If passwords don't match, then return an invalid credentials response
 	if !match {
+		app.recordLoginFailure(failures, user)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	err = app.releaseLoginAttempt(keys...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Deleted accounts can only log in during the grace period. The account
+	// is restored once the login is complete, in createSession()
+	if user.DeletedAt != nil && time.Since(*user.DeletedAt) > app.config.users.deletionGrace {
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	// Password is correct, so we will generate a authentication token
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	app.completeLogin(w, r, user)
+}
+
+// The completeLogin() method finishes a login once the user proved who they
+// are. Accounts with two-factor authentication get a short-lived token that
+// has to be exchanged together with a code at POST /v1/tokens/2fa, the others
+// get a new session straight away
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if enabled {
+		token, err := app.models.Tokens.New(user.ID, twoFactorPendingTTL, data.ScopeTwoFactorPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"two_factor_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// The failed logins before this one no longer count
+	err = app.models.LoginThrottles.Reset(data.LoginEmailKey(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.createSession(w, r, user)
+}
+
+// The createSession() method completes a login by issuing the authentication
+// and refresh tokens of a new session. Logging in to a deleted account during
+// its grace period restores it, but only here, after every factor passed
+func (app *application) createSession(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if user.DeletedAt != nil {
+		if time.Since(*user.DeletedAt) > app.config.users.deletionGrace {
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+		user.DeletedAt = nil
+		err := app.models.Users.Update(user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+	token, refresh, err := app.models.Tokens.NewSession(user.ID, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, r.UserAgent())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.signAccessToken(token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Return the tokens to the client
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The signAccessToken() method replaces the plaintext of a session's access
+// token with a signed token when the server issues those. The database token
+// stays behind as the record of the session, and the signed token points to
+// it so that the session can still be listed and logged out of. A signed
+// token cannot be revoked though, it is good until it expires
+func (app *application) signAccessToken(token *data.Token) error {
+	if app.config.tokens.format != "signed" {
+		return nil
+	}
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		return err
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	claims := jwt.Claims{
+		Subject:     user.ID,
+		Activated:   user.Activated,
+		Permissions: permissions,
+		SessionID:   base64.RawURLEncoding.EncodeToString(token.Hash),
+		IssuedAt:    time.Now().Unix(),
+		ExpiresAt:   token.Expiry.Unix(),
+	}
+	token.Plaintext, err = app.config.tokens.signingKeys.Sign(claims)
+	return err
+}
+
+// createPasswordResetTokenHandler for the "POST /v1/tokens/password-reset" endpoint
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// The same response is sent whether or not the account exists so that
+	// this endpoint cannot be used to find out who has an account
+	env := envelope{"message": "if an account with that email address exists, an email will be sent to it with password reset instructions"}
+	// Get the user details based on the provided email
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Accounts that were never activated or were deleted cannot reset their password
+	if user.Activated && user.DeletedAt == nil {
+		// Generate a password reset token
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.background(func() {
+			data := map[string]interface{}{
+				"passwordResetToken": token.Plaintext,
+			}
+			// Send the password reset email
+			err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+			if err != nil {
+				// log errors
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+	// Write a 202 Accepted Status
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createActivationTokenHandler for the "POST /v1/tokens/activation" endpoint
+// reissues the activation token of an account that has not been activated yet
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
-	// Return the authentication token to the client
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// As with password resets the response does not reveal whether the
+	// account exists, is already activated or is being throttled
+	env := envelope{"message": "if an unactivated account with that email address exists, an email will be sent to it with activation instructions"}
+	// Get the user details based on the provided email
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !user.Activated {
+		// Only send one activation email per address every few minutes
+		count, err := app.models.Tokens.CountCreatedSince(data.ScopeActivation, user.ID, time.Now().Add(-5*time.Minute))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if count == 0 {
+			// Generate a new activation token
+			token, err := app.models.Tokens.New(user.ID, 1*24*time.Hour, data.ScopeActivation)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.background(func() {
+				data := map[string]interface{}{
+					"activationToken": token.Plaintext,
+				}
+				// Send the activation email
+				err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
+				if err != nil {
+					// log errors
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
+	}
+	// Write a 202 Accepted Status
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
+}
 
-}
\ No newline at end of file
+// listAuthenticationTokensHandler for the "GET /v1/tokens/authentication" endpoint
+// shows the user where they are logged in
+func (app *application) listAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetSession(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAuthenticationTokenHandler for the "DELETE /v1/tokens/authentication" endpoint
+// logs the client out by revoking the token it authenticated with and
+// the refresh token of the same login
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.models.Tokens.DeleteSession(app.contextGetSession(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAllAuthenticationTokensHandler for the "DELETE /v1/tokens/authentication/all"
+// endpoint logs the user out of every session
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	err := app.models.Tokens.DeleteAllSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out of all sessions"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createRefreshedTokensHandler for the "POST /v1/tokens/refresh" endpoint
+// trades a refresh token for a new authentication and refresh token
+func (app *application) createRefreshedTokensHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the plaintext refresh token
+	var input struct {
+		TokenPlaintext string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	if data.ValidateTokenPlainText(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Rotate the refresh token
+	token, refresh, err := app.models.Tokens.Rotate(input.TokenPlaintext, app.config.tokens.accessTTL, app.config.tokens.refreshTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.PrintInfo("refresh token reused, session revoked", map[string]string{
+				"request_url": r.URL.String(),
+			})
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.signAccessToken(token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Return the new tokens to the client
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createMagicLinkTokenHandler for the "POST /v1/tokens/magic-link" endpoint
+// emails a single-use token that logs the user in without their password
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// As with password resets the response does not reveal whether the
+	// account exists, is activated or is being throttled
+	env := envelope{"message": "if an activated account with that email address exists, an email will be sent to it with a login link"}
+	// Get the user details based on the provided email
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Only activated accounts may log in, the same as requireActivatedUser
+	if user.Activated && user.DeletedAt == nil {
+		// Only send one login link per address every minute
+		count, err := app.models.Tokens.CountCreatedSince(data.ScopeMagicLink, user.ID, time.Now().Add(-time.Minute))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if count == 0 {
+			token, err := app.models.Tokens.New(user.ID, 15*time.Minute, data.ScopeMagicLink)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.background(func() {
+				data := map[string]interface{}{
+					"magicLinkToken": token.Plaintext,
+				}
+				// Send the login link
+				err = app.mailer.Send(user.Email, "token_magic_link.tmpl", data)
+				if err != nil {
+					// log errors
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
+	}
+	// Write a 202 Accepted Status
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// exchangeMagicLinkTokenHandler for the "POST /v1/tokens/magic-link/exchange"
+// endpoint logs the user in with the token from their email
+func (app *application) exchangeMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	if data.ValidateTokenPlainText(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// The token is single-use, so it is consumed before anything else
+	userID, err := app.models.Tokens.Consume(data.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	user, err := app.models.Users.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Deleted accounts cannot be restored with a link
+	if user.DeletedAt != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	if !user.Activated {
+		app.inactiveAccountResponse(w, r)
+		return
+	}
+	// Any older link goes with it
+	err = app.models.Tokens.DeleteAllForUsers(data.ScopeMagicLink, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// The link stands in for the password only, not for the second factor
+	app.completeLogin(w, r, user)
+}
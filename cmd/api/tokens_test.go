@@ -0,0 +1,54 @@
+// Filename: cmd/api/tokens_test.go
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+)
+
+func TestExchangeMagicLinkTokenOnce(t *testing.T) {
+	app := newTestApplication(t)
+	user := newTestUser(t, app)
+
+	token, err := app.models.Tokens.New(user.ID, time.Minute, data.ScopeMagicLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every request races for the same link, only one may get a session
+	const attempts = 10
+	statuses := make([]int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := strings.NewReader(`{"token": "` + token.Plaintext + `"}`)
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/v1/tokens/magic-link/exchange", body)
+			app.exchangeMagicLinkTokenHandler(rr, r)
+			statuses[i] = rr.Code
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusUnauthorized:
+		default:
+			t.Fatalf("got status %d; want %d or %d", status, http.StatusCreated, http.StatusUnauthorized)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("got %d sessions; want 1", created)
+	}
+}
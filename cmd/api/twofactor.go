@@ -0,0 +1,266 @@
+// Filename: cmd/api/twofactor.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"forum.castillojadah.net/internals/data"
+	"forum.castillojadah.net/internals/totp"
+	"forum.castillojadah.net/internals/validator"
+)
+
+// The name authenticator apps show next to the codes
+const totpIssuer = "Hifive"
+
+// How long a password login waits for its second factor
+const twoFactorPendingTTL = 5 * time.Minute
+
+// enrollTwoFactorHandler for the "POST /v1/users/me/2fa" endpoint. It returns
+// a new secret that only takes effect once confirmed with a code
+func (app *application) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !app.checkPassword(w, r, user, input.Password) {
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.TwoFactor.SetPending(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v.AddError("two_factor", "is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	env := envelope{"secret": secret, "otpauth_uri": totp.URI(totpIssuer, user.Email, secret)}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTwoFactorHandler for the "PUT /v1/users/me/2fa/confirmed" endpoint.
+// The recovery codes are only ever shown in its response
+func (app *application) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	if data.ValidateTwoFactorCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	twoFactor, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if twoFactor == nil || twoFactor.Enabled {
+		v.AddError("two_factor", "there is no enrollment to confirm")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	step, ok := totp.Validate(twoFactor.Secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	_, err = app.models.TwoFactor.UseStep(user.ID, step)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	recoveryCodes, err := data.GenerateRecoveryCodes(data.RecoveryCodeCount)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.TwoFactor.Enable(user.ID, recoveryCodes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": recoveryCodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableTwoFactorHandler for the "DELETE /v1/users/me/2fa" endpoint. Both
+// the password and a code are needed
+func (app *application) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTwoFactorCode(v, input.Code)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !app.checkPassword(w, r, user, input.Password) {
+		return
+	}
+	twoFactor, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if twoFactor == nil || !twoFactor.Enabled {
+		v.AddError("two_factor", "is not enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	ok, err := app.checkTwoFactorCode(twoFactor, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	err = app.models.TwoFactor.Disable(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication was disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createTwoFactorAuthenticationTokenHandler for the "POST /v1/tokens/2fa"
+// endpoint exchanges the 2fa-pending token of a password login and a code
+// for the authentication and refresh tokens
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	data.ValidateTokenPlainText(v, input.TokenPlaintext)
+	data.ValidateTwoFactorCode(v, input.Code)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user, err := app.models.Users.GetForToken(data.ScopeTwoFactorPending, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Wrong codes count towards the same lockout as wrong passwords
+	emailKey := data.LoginEmailKey(user.Email)
+	keys := []string{emailKey, data.LoginIPKey(app.clientIP(r))}
+	failures, ok := app.reserveLoginAttempt(w, r, keys...)
+	if !ok {
+		return
+	}
+	twoFactor, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if twoFactor == nil || !twoFactor.Enabled {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	ok, err = app.checkTwoFactorCode(twoFactor, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.recordLoginFailure(failures, user)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	err = app.releaseLoginAttempt(keys...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// The pending token has done its job
+	err = app.models.Tokens.DeleteAllForUsers(data.ScopeTwoFactorPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.LoginThrottles.Reset(emailKey)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.createSession(w, r, user)
+}
+
+// The checkTwoFactorCode() method accepts either a TOTP code, which cannot be
+// used twice, or one of the user's unused recovery codes
+func (app *application) checkTwoFactorCode(twoFactor *data.TwoFactor, code string) (bool, error) {
+	step, ok := totp.Validate(twoFactor.Secret, code, time.Now())
+	if ok {
+		return app.models.TwoFactor.UseStep(twoFactor.UserID, step)
+	}
+	return app.models.TwoFactor.UseRecoveryCode(twoFactor.UserID, code)
+}
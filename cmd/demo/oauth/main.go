@@ -0,0 +1,254 @@
+// Filename: cmd/demo/oauth/main.go
+
+// The oauth demo is a small third-party client. It runs the authorization
+// code flow with PKCE against a running API, using an httptest server as
+// its redirect URI, and calls the API with the token it is given
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+)
+
+type client struct {
+	api     string
+	session string
+}
+
+// The do() method sends a JSON request to the API and decodes the response
+func (c *client) do(method, path string, token string, body, dst interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.api+path, &buf)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	js, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, js)
+	}
+	if dst == nil {
+		return nil
+	}
+	return json.Unmarshal(js, dst)
+}
+
+func main() {
+	api := flag.String("api", "http://localhost:4000", "API base URL")
+	email := flag.String("email", "", "Email of the user that approves the client")
+	password := flag.String("password", "", "Password of the user that approves the client")
+	flag.Parse()
+
+	c := &client{api: strings.TrimSuffix(*api, "/")}
+
+	// Log in as the user, the way the forum frontend would
+	var login struct {
+		AuthenticationToken string `json:"authentication_token"`
+	}
+	err := c.do(http.MethodPost, "/v1/tokens/authentication", "", map[string]string{
+		"email":    *email,
+		"password": *password,
+	}, &login)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if login.AuthenticationToken == "" {
+		log.Fatal("the user has two-factor authentication enabled, which the demo does not handle")
+	}
+	c.session = login.AuthenticationToken
+
+	// The callback server receives the authorization code and exchanges it
+	var (
+		verifier = newVerifier()
+		creds    struct{ id, secret string }
+		result   = make(chan error, 1)
+		token    string
+	)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qs := r.URL.Query()
+		if qs.Get("state") != "demo-state" {
+			result <- errors.New("state does not match")
+			return
+		}
+		if e := qs.Get("error"); e != "" {
+			result <- fmt.Errorf("authorization failed: %s", e)
+			return
+		}
+		var err error
+		token, err = exchange(c.api, creds.id, creds.secret, qs.Get("code"), "http://"+r.Host+"/callback", verifier)
+		result <- err
+		fmt.Fprintln(w, "you can close this window")
+	}))
+	defer callback.Close()
+	redirectURI := callback.URL + "/callback"
+
+	// Register the demo as a confidential client
+	var registered struct {
+		Client struct {
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+			ID           int64  `json:"id"`
+		} `json:"client"`
+	}
+	err = c.do(http.MethodPost, "/v1/oauth/clients", c.session, map[string]interface{}{
+		"name":          "OAuth demo",
+		"redirect_uris": []string{redirectURI},
+		"scopes":        []string{"forums:read"},
+		"confidential":  true,
+	}, &registered)
+	if err != nil {
+		log.Fatal(err)
+	}
+	creds.id = registered.Client.ClientID
+	creds.secret = registered.Client.ClientSecret
+	defer c.do(http.MethodDelete, fmt.Sprintf("/v1/oauth/clients/%d", registered.Client.ID), c.session, nil, nil)
+	log.Printf("registered client %s", creds.id)
+
+	// Ask for consent and approve it on the user's behalf
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {creds.id},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"forums:read"},
+		"state":                 {"demo-state"},
+		"code_challenge":        {challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	var consent map[string]interface{}
+	err = c.do(http.MethodGet, "/v1/oauth/authorize?"+params.Encode(), c.session, nil, &consent)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("consent requested: %v", consent)
+
+	approval := map[string]interface{}{"approve": true}
+	for key := range params {
+		approval[key] = params.Get(key)
+	}
+	var decision struct {
+		RedirectURI string `json:"redirect_uri"`
+	}
+	err = c.do(http.MethodPost, "/v1/oauth/authorize", c.session, approval, &decision)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Follow the redirect like the user's browser would
+	res, err := http.Get(decision.RedirectURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res.Body.Close()
+	if err = <-result; err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("received access token %s", token)
+
+	// Use the token
+	var forums map[string]interface{}
+	err = c.do(http.MethodGet, "/v1/forum", token, nil, &forums)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listed forums with the access token")
+
+	// And revoke it
+	err = revoke(c.api, creds.id, creds.secret, token)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = c.do(http.MethodGet, "/v1/forum", token, nil, nil)
+	if err == nil {
+		log.Fatal("the revoked token still works")
+	}
+	log.Printf("token revoked")
+}
+
+// The exchange() function trades an authorization code for an access token
+func exchange(api, clientID, secret, code, redirectURI, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	err := postForm(api+"/v1/oauth/token", clientID, secret, form, &token)
+	return token.AccessToken, err
+}
+
+// The revoke() function revokes an access token
+func revoke(api, clientID, secret, token string) error {
+	return postForm(api+"/v1/oauth/revoke", clientID, secret, url.Values{"token": {token}}, nil)
+}
+
+func postForm(endpoint, clientID, secret string, form url.Values, dst interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, secret)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	js, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %s: %s: %s", endpoint, res.Status, js)
+	}
+	if dst == nil {
+		return nil
+	}
+	return json.Unmarshal(js, dst)
+}
+
+// The newVerifier() function creates a random PKCE code verifier
+func newVerifier() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The challenge() function derives the S256 code challenge of a verifier
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,196 @@
+// Filename: internal/data/apitokens.go
+
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"forum.castillojadah.net/internals/validator"
+	"github.com/lib/pq"
+)
+
+// Personal access tokens start with this prefix so they are easy to tell
+// apart from session tokens and to spot when they leak, for example by
+// secret scanners
+const APITokenPrefix = "hfp_"
+
+// The APIToken type is a long-lived token a user created for a bot or an
+// integration. The plaintext is only ever returned when it is created
+type APIToken struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UserID      int64       `json:"-"`
+	Plaintext   string      `json:"token,omitempty"`
+	Label       string      `json:"label"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// IsAPIToken() reports whether a bearer token is a personal access token
+func IsAPIToken(tokenPlaintext string) bool {
+	return strings.HasPrefix(tokenPlaintext, APITokenPrefix)
+}
+
+func ValidateAPIToken(v *validator.Validator, token *APIToken) {
+	v.Check(token.Label != "", "label", "must be provided")
+	v.Check(len(token.Label) <= 100, "label", "must not be more than 100 bytes long")
+	v.Check(len(token.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(token.Permissions), "permissions", "must not contain duplicate values")
+	if token.Expiry != nil {
+		v.Check(token.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Check that the plaintext is the prefix followed by 26 bytes
+func ValidateAPITokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+	v.Check(IsAPIToken(tokenPlaintext), "token", "must be a personal access token")
+	v.Check(len(tokenPlaintext) == len(APITokenPrefix)+26, "token", "must be 30 bytes long")
+}
+
+// Define an APITokenModel which wraps a sql.DB connection pool
+type APITokenModel struct {
+	DB *sql.DB
+}
+
+// Insert() creates the token and fills in its plaintext
+func (m APITokenModel) Insert(token *APIToken) error {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	token.Plaintext = APITokenPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(token.Plaintext))
+
+	query := `
+		INSERT INTO api_tokens (user_id, hash, label, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+	args := []interface{}{token.UserID, hash[:], token.Label, pq.Array(token.Permissions), token.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt)
+}
+
+// GetForPlaintext() returns the unexpired token matching a plaintext
+func (m APITokenModel) GetForPlaintext(tokenPlaintext string) (*APIToken, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		SELECT id, created_at, user_id, label, permissions, expiry, last_used_at
+		FROM api_tokens
+		WHERE hash = $1
+		AND (expiry IS NULL OR expiry > NOW())
+	`
+	var token APIToken
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&token.ID,
+		&token.CreatedAt,
+		&token.UserID,
+		&token.Label,
+		pq.Array(&token.Permissions),
+		&token.Expiry,
+		&token.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+// GetAllForUser() returns the tokens of a user, newest first
+func (m APITokenModel) GetAllForUser(userID int64) ([]*APIToken, error) {
+	query := `
+		SELECT id, created_at, user_id, label, permissions, expiry, last_used_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY id DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []*APIToken{}
+	for rows.Next() {
+		var token APIToken
+		err := rows.Scan(
+			&token.ID,
+			&token.CreatedAt,
+			&token.UserID,
+			&token.Label,
+			pq.Array(&token.Permissions),
+			&token.Expiry,
+			&token.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Delete() revokes a token of a user
+func (m APITokenModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+		DELETE FROM api_tokens
+		WHERE id = $1 AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Touch() records when a token was last used, at most once a minute
+func (m APITokenModel) Touch(id int64) error {
+	query := `
+		UPDATE api_tokens
+		SET last_used_at = NOW()
+		WHERE id = $1
+		AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
@@ -0,0 +1,116 @@
+// Filename: internal/data/cache.go
+
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// The PermissionCache type keeps the permissions of recently seen users in
+// memory so that authorizing a request does not have to query the database.
+// Entries expire after the TTL and are dropped whenever a user's
+// permissions or roles are changed through the models
+type PermissionCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[int64]permissionCacheEntry
+	hits    int64
+	misses  int64
+}
+
+type permissionCacheEntry struct {
+	permissions Permissions
+	expiry      time.Time
+}
+
+// The PermissionCacheStats type reports how well the cache is doing
+type PermissionCacheStats struct {
+	Entries int     `json:"entries"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// The NewPermissionCache() function creates a cache whose entries live for ttl
+func NewPermissionCache(ttl time.Duration) *PermissionCache {
+	return &PermissionCache{
+		ttl:     ttl,
+		entries: make(map[int64]permissionCacheEntry),
+	}
+}
+
+// Get() returns the cached permissions of a user, if they have not expired.
+// A nil cache never has anything, so models work without one
+func (c *PermissionCache) Get(userID int64) (Permissions, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[userID]
+	if !found || time.Now().After(entry.expiry) {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return entry.permissions, true
+}
+
+// Set() caches the permissions of a user
+func (c *PermissionCache) Set(userID int64, permissions Permissions) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[userID] = permissionCacheEntry{
+		permissions: permissions,
+		expiry:      time.Now().Add(c.ttl),
+	}
+}
+
+// Invalidate() forgets the cached permissions of the given users
+func (c *PermissionCache) Invalidate(userIDs ...int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, userID := range userIDs {
+		delete(c.entries, userID)
+	}
+}
+
+// Purge() drops the expired entries so the cache does not grow forever
+func (c *PermissionCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for userID, entry := range c.entries {
+		if now.After(entry.expiry) {
+			delete(c.entries, userID)
+		}
+	}
+}
+
+// Stats() returns the number of entries and the hit/miss counts
+func (c *PermissionCache) Stats() PermissionCacheStats {
+	if c == nil {
+		return PermissionCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := PermissionCacheStats{
+		Entries: len(c.entries),
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRate = float64(c.hits) / float64(total)
+	}
+	return stats
+}
@@ -0,0 +1,270 @@
+// Filename: internal/data/categories.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"forum.castillojadah.net/internals/validator"
+)
+
+var (
+	ErrDuplicateSlug   = errors.New("duplicate slug")
+	ErrUnknownCategory = errors.New("unknown category")
+)
+
+// Slugs are lowercase words joined by hyphens so they read well in URLs
+var SlugRX = regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`)
+
+// The Category type is a board that posts are filed under
+type Category struct {
+	ID           int64     `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Name         string    `json:"name"`
+	Slug         string    `json:"slug"`
+	Description  string    `json:"description"`
+	Position     int       `json:"position"`
+	ParentID     *int64    `json:"parent_id"`
+	PostCount    int       `json:"post_count"`
+	CommentCount int       `json:"comment_count"`
+	Version      int32     `json:"version"`
+}
+
+func ValidateCategory(v *validator.Validator, category *Category) {
+	v.Check(category.Name != "", "name", "must be provided")
+	v.Check(len(category.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(category.Slug != "", "slug", "must be provided")
+	v.Check(len(category.Slug) <= 100, "slug", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(category.Slug, SlugRX), "slug", "must only contain lowercase letters, digits and single hyphens")
+	v.Check(len(category.Description) <= 1000, "description", "must not be more than 1000 bytes long")
+	v.Check(category.Position >= 0, "position", "must not be negative")
+	if category.ParentID != nil {
+		v.Check(*category.ParentID != category.ID, "parent_id", "must not be the category itself")
+	}
+}
+
+// The Slugify() function derives a slug from a category name
+func Slugify(name string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			hyphen = false
+		case b.Len() > 0 && !hyphen:
+			b.WriteByte('-')
+			hyphen = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// Define a CategoryModel which wraps a sql.DB connection pool
+type CategoryModel struct {
+	DB *sql.DB
+}
+
+// The columns every category query selects, including the number of posts
+// filed directly under the category and the comments on them
+const categoryColumns = `
+	categories.id, categories.created_at, categories.name, categories.slug,
+	categories.description, categories.position, categories.parent_id,
+	(SELECT COUNT(*) FROM posts WHERE posts.category_id = categories.id),
+	(SELECT COUNT(*) FROM comments INNER JOIN posts ON posts.id = comments.post_id
+	 WHERE posts.category_id = categories.id),
+	categories.version
+`
+
+func scanCategory(row interface{ Scan(...interface{}) error }, category *Category) error {
+	var parentID sql.NullInt64
+	err := row.Scan(
+		&category.ID,
+		&category.CreatedAt,
+		&category.Name,
+		&category.Slug,
+		&category.Description,
+		&category.Position,
+		&parentID,
+		&category.PostCount,
+		&category.CommentCount,
+		&category.Version,
+	)
+	category.ParentID = nullableID(parentID)
+	return err
+}
+
+// categoryError() maps the constraint violations of a category write
+func categoryError(err error) error {
+	switch {
+	case err.Error() == `pq: duplicate key value violates unique constraint "categories_slug_key"`:
+		return ErrDuplicateSlug
+	case err.Error() == `pq: insert or update on table "categories" violates foreign key constraint "categories_parent_id_fkey"`:
+		return ErrUnknownCategory
+	default:
+		return err
+	}
+}
+
+// Insert() creates a new category
+func (m CategoryModel) Insert(category *Category) error {
+	query := `
+		INSERT INTO categories (name, slug, description, position, parent_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, version
+	`
+	args := []interface{}{
+		category.Name,
+		category.Slug,
+		category.Description,
+		category.Position,
+		category.ParentID,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&category.ID, &category.CreatedAt, &category.Version)
+	if err != nil {
+		return categoryError(err)
+	}
+	return nil
+}
+
+// GetBySlug() returns the category with the given slug
+func (m CategoryModel) GetBySlug(slug string) (*Category, error) {
+	query := `SELECT ` + categoryColumns + `
+		FROM categories
+		WHERE categories.slug = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var category Category
+	err := scanCategory(m.DB.QueryRowContext(ctx, query, slug), &category)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &category, nil
+}
+
+// GetAll() returns every category ordered by position. Clients build the
+// tree from the parent IDs
+func (m CategoryModel) GetAll() ([]*Category, error) {
+	query := `SELECT ` + categoryColumns + `
+		FROM categories
+		ORDER BY categories.position, categories.name, categories.id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []*Category{}
+	for rows.Next() {
+		var category Category
+		err := scanCategory(rows, &category)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, &category)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+// IsDescendant() reports whether categoryID sits somewhere below ancestorID,
+// which would make a loop if ancestorID were moved under it
+func (m CategoryModel) IsDescendant(categoryID, ancestorID int64) (bool, error) {
+	query := `
+		WITH RECURSIVE ancestors AS (
+			SELECT id, parent_id FROM categories WHERE id = $1
+			UNION
+			SELECT categories.id, categories.parent_id
+			FROM categories
+			INNER JOIN ancestors ON categories.id = ancestors.parent_id
+		)
+		SELECT EXISTS(SELECT 1 FROM ancestors WHERE id = $2)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var descendant bool
+	err := m.DB.QueryRowContext(ctx, query, categoryID, ancestorID).Scan(&descendant)
+	return descendant, err
+}
+
+// Update() edits a category, using the version for optimistic locking
+func (m CategoryModel) Update(category *Category) error {
+	query := `
+		UPDATE categories
+		SET name = $1, slug = $2, description = $3, position = $4, parent_id = $5, version = version + 1
+		WHERE id = $6 AND version = $7
+		RETURNING version
+	`
+	args := []interface{}{
+		category.Name,
+		category.Slug,
+		category.Description,
+		category.Position,
+		category.ParentID,
+		category.ID,
+		category.Version,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&category.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return categoryError(err)
+		}
+	}
+	return nil
+}
+
+// Delete() removes a category. Its posts become uncategorized and its
+// subcategories move up to the top level
+func (m CategoryModel) Delete(id int64) error {
+	query := `
+		DELETE FROM categories
+		WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// nullableID() turns a nullable ID column into a pointer for JSON
+func nullableID(id sql.NullInt64) *int64 {
+	if !id.Valid {
+		return nil
+	}
+	return &id.Int64
+}
@@ -11,10 +11,19 @@ import (
 )
 
 type Comment struct {
-	ID         int64     `json:"id"`
-	CreatedAt  time.Time `json:"-"`
-	Content    string    `json:"content"`
-	Version    int32     `json:"version"`
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"-"`
+	PostID     int64      `json:"post_id,omitempty"`
+	ParentID   int64      `json:"parent_id,omitempty"`
+	UserID     int64      `json:"-"`
+	Author     *Author    `json:"author,omitempty"`
+	Content    string     `json:"content"`
+	Version    int32      `json:"version"`
+	LikeCount  int        `json:"like_count"`
+	LikedByMe  bool       `json:"liked_by_me"`
+	Depth      int        `json:"depth,omitempty"`
+	ReplyCount int        `json:"reply_count,omitempty"`
+	Replies    []*Comment `json:"replies,omitempty"`
 }
 
 func ValidateComment(v *validator.Validator, comment *Comment) {
@@ -32,13 +41,20 @@ type CommentModel struct {
 // Insert() allows us  to create a new Comment
 func (m CommentModel) Insert(comment *Comment) error {
 	query := `
-		INSERT INTO comments (content)
-		VALUES ($1)
-		RETURNING id, created_at, version
+		WITH comment AS (
+			INSERT INTO comments (post_id, parent_id, user_id, content)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at, version
+		), activity AS (
+			UPDATE posts SET last_activity_at = NOW() WHERE id = $1
+		)
+		SELECT id, created_at, version FROM comment
 	`
+	// Top-level comments are stored with a NULL parent
+	parentID := sql.NullInt64{Int64: comment.ParentID, Valid: comment.ParentID != 0}
 	// Collect the data fields into a slice
 	args := []interface{}{
-		comment.Content,
+		comment.PostID, parentID, comment.UserID, comment.Content,
 	}
 	// Create a context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -47,20 +63,26 @@ func (m CommentModel) Insert(comment *Comment) error {
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&comment.ID, &comment.CreatedAt, &comment.Version)
 }
 
-// Get() allows us to retrieve a specific Comment
-func (m CommentModel) Get(id int64) (*Comment, error) {
+// Get() allows us to retrieve a specific Comment as seen by userID
+func (m CommentModel) Get(id int64, userID int64) (*Comment, error) {
 	// Ensure that there is a valid id
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	// Create the query
 	query := `
-		SELECT id, created_at, content, version
+		SELECT comments.id, comments.created_at, comments.post_id, comments.parent_id, comments.user_id,
+		users.username, comments.content, comments.version,
+		(SELECT COUNT(*) FROM likedcomment WHERE likedcomment.comments_id = comments.id),
+		EXISTS(SELECT 1 FROM likedcomment WHERE likedcomment.comments_id = comments.id AND likedcomment.users_id = $2)
 		FROM comments
-		WHERE id = $1
+		LEFT JOIN users ON users.id = comments.user_id
+		WHERE comments.id = $1
 	`
 	// Declare a Comment variable to hold the returned data
 	var comment Comment
+	var postID, parentID, authorID sql.NullInt64
+	var authorName sql.NullString
 
 	// Create a context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -68,11 +90,17 @@ func (m CommentModel) Get(id int64) (*Comment, error) {
 	defer cancel()
 
 	// Execute the query using QueryRow()
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
 		&comment.ID,
 		&comment.CreatedAt,
+		&postID,
+		&parentID,
+		&authorID,
+		&authorName,
 		&comment.Content,
 		&comment.Version,
+		&comment.LikeCount,
+		&comment.LikedByMe,
 	)
 	// Handle any errors
 	if err != nil {
@@ -84,6 +112,11 @@ func (m CommentModel) Get(id int64) (*Comment, error) {
 			return nil, err
 		}
 	}
+	// Comments older than threads have no post
+	comment.PostID = postID.Int64
+	comment.ParentID = parentID.Int64
+	comment.UserID = authorID.Int64
+	comment.Author = newAuthor(authorID, authorName)
 	// Success
 	return &comment, nil
 }
@@ -158,22 +191,107 @@ func (m CommentModel) Delete(id int64) error {
 }
 
 // The GetAll() method retuns a list of all the comments sorted by id
-func (m CommentModel) GetAll(content string, filters Filters) ([]*Comment, Metadata, error) {
+// with the likes of userID marked
+func (m CommentModel) GetAll(content string, userID int64, filters Filters) ([]*Comment, Metadata, error) {
 
 	// Construct the query
 
 	query := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), id, created_at, content, version
+		SELECT COUNT(*) OVER(), comments.id, comments.created_at, comments.post_id, comments.parent_id, comments.user_id,
+		users.username, comments.content, comments.version,
+		(SELECT COUNT(*) FROM likedcomment WHERE likedcomment.comments_id = comments.id),
+		EXISTS(SELECT 1 FROM likedcomment WHERE likedcomment.comments_id = comments.id AND likedcomment.users_id = $4)
 		FROM comments
-		AND (to_tsvector('simple', content) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		ORDER BY %s %s, id ASC
+		LEFT JOIN users ON users.id = comments.user_id
+		WHERE (to_tsvector('simple', comments.content) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		ORDER BY comments.%s %s, comments.id ASC
 		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortOrder())
 
+	args := []interface{}{content, filters.limit(), filters.offset(), userID}
+	return m.list(query, args, filters)
+}
+
+// The GetAllForPost() method returns the comments that belong to a specific post
+// with the likes of userID marked
+func (m CommentModel) GetAllForPost(postID int64, content string, userID int64, filters Filters) ([]*Comment, Metadata, error) {
+
+	// Construct the query
+
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), comments.id, comments.created_at, comments.post_id, comments.parent_id, comments.user_id,
+		users.username, comments.content, comments.version,
+		(SELECT COUNT(*) FROM likedcomment WHERE likedcomment.comments_id = comments.id),
+		EXISTS(SELECT 1 FROM likedcomment WHERE likedcomment.comments_id = comments.id AND likedcomment.users_id = $5)
+		FROM comments
+		LEFT JOIN users ON users.id = comments.user_id
+		WHERE comments.post_id = $1
+		AND (to_tsvector('simple', comments.content) @@ plainto_tsquery('simple', $2) OR $2 = '')
+		ORDER BY comments.%s %s, comments.id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortOrder())
+
+	args := []interface{}{postID, content, filters.limit(), filters.offset(), userID}
+	return m.list(query, args, filters)
+}
+
+// The GetAllByAuthor() method returns every comment written by a user, oldest
+// first, for their personal data export
+func (m CommentModel) GetAllByAuthor(userID int64) ([]*Comment, error) {
+	query := `
+		SELECT comments.id, comments.created_at, comments.post_id, comments.parent_id, comments.user_id,
+		users.username, comments.content, comments.version,
+		(SELECT COUNT(*) FROM likedcomment WHERE likedcomment.comments_id = comments.id),
+		EXISTS(SELECT 1 FROM likedcomment WHERE likedcomment.comments_id = comments.id AND likedcomment.users_id = $1)
+		FROM comments
+		LEFT JOIN users ON users.id = comments.user_id
+		WHERE comments.user_id = $1
+		ORDER BY comments.id ASC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := []*Comment{}
+	for rows.Next() {
+		var comment Comment
+		var postID, parentID, authorID sql.NullInt64
+		var authorName sql.NullString
+		err := rows.Scan(
+			&comment.ID,
+			&comment.CreatedAt,
+			&postID,
+			&parentID,
+			&authorID,
+			&authorName,
+			&comment.Content,
+			&comment.Version,
+			&comment.LikeCount,
+			&comment.LikedByMe,
+		)
+		if err != nil {
+			return nil, err
+		}
+		comment.PostID = postID.Int64
+		comment.ParentID = parentID.Int64
+		comment.UserID = authorID.Int64
+		comment.Author = newAuthor(authorID, authorName)
+		comments = append(comments, &comment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// The list() method runs a paginated comment query and scans the resultset
+func (m CommentModel) list(query string, args []interface{}, filters Filters) ([]*Comment, Metadata, error) {
 	// Create a 3-second-timout context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	// Execute the query
-	args := []interface{}{content, filters.limit(), filters.offset()}
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -186,17 +304,29 @@ func (m CommentModel) GetAll(content string, filters Filters) ([]*Comment, Metad
 	// Iterate over the rows in the resultset
 	for rows.Next() {
 		var comment Comment
+		var postID, parentID, authorID sql.NullInt64
+		var authorName sql.NullString
 		// Scan the values from the row into comment
 		err := rows.Scan(
 			&totalRecords,
 			&comment.ID,
 			&comment.CreatedAt,
+			&postID,
+			&parentID,
+			&authorID,
+			&authorName,
 			&comment.Content,
 			&comment.Version,
+			&comment.LikeCount,
+			&comment.LikedByMe,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
+		comment.PostID = postID.Int64
+		comment.ParentID = parentID.Int64
+		comment.UserID = authorID.Int64
+		comment.Author = newAuthor(authorID, authorName)
 		// Add the Comment to our slice
 		comments = append(comments, &comment)
 	}
@@ -207,4 +337,108 @@ func (m CommentModel) GetAll(content string, filters Filters) ([]*Comment, Metad
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 	// Return the slice of Comments
 	return comments, metadata, nil
-}
\ No newline at end of file
+}
+
+// The GetTreeForPost() method returns a page of the comments directly under
+// parentID (zero for the top level of the post) with their replies nested up
+// to maxDepth levels below them. Each comment carries at most repliesLimit
+// replies, the rest can be paged through by using it as the parentID.
+// The likes of userID are marked and the whole thread is fetched with a
+// single recursive query
+func (m CommentModel) GetTreeForPost(postID, parentID, userID int64, maxDepth, repliesLimit int, filters Filters) ([]*Comment, Metadata, error) {
+	// Rank every comment of the post amongst its siblings, then walk down
+	// from the requested page of roots
+	query := `
+		WITH RECURSIVE ranked AS (
+			SELECT id, parent_id,
+			ROW_NUMBER() OVER (PARTITION BY parent_id ORDER BY created_at, id) AS position,
+			COUNT(*) OVER (PARTITION BY parent_id) AS siblings
+			FROM comments
+			WHERE post_id = $1
+		), thread AS (
+			SELECT ranked.id, ranked.siblings, 0 AS depth, ARRAY[ranked.id] AS path
+			FROM ranked
+			WHERE ranked.parent_id IS NOT DISTINCT FROM $2
+			AND ranked.position > $5 AND ranked.position <= $5 + $4
+			UNION ALL
+			SELECT ranked.id, ranked.siblings, thread.depth + 1, thread.path || ranked.id
+			FROM ranked
+			INNER JOIN thread ON ranked.parent_id = thread.id
+			WHERE thread.depth < $3
+			AND ranked.position <= $6
+		)
+		SELECT thread.siblings, thread.depth, comments.id, comments.created_at, comments.post_id,
+		comments.parent_id, comments.user_id, users.username, comments.content, comments.version,
+		(SELECT COUNT(*) FROM likedcomment WHERE likedcomment.comments_id = comments.id),
+		EXISTS(SELECT 1 FROM likedcomment WHERE likedcomment.comments_id = comments.id AND likedcomment.users_id = $7),
+		(SELECT COUNT(*) FROM comments AS replies WHERE replies.parent_id = comments.id)
+		FROM thread
+		INNER JOIN comments ON comments.id = thread.id
+		LEFT JOIN users ON users.id = comments.user_id
+		ORDER BY thread.path`
+
+	// Create a 3-second-timout context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	// Execute the query
+	root := sql.NullInt64{Int64: parentID, Valid: parentID != 0}
+	args := []interface{}{postID, root, maxDepth, filters.limit(), filters.offset(), repliesLimit, userID}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	// Close the resultset
+	defer rows.Close()
+	totalRecords := 0
+	// The rows come back depth first so a parent is always seen before its replies
+	comments := []*Comment{}
+	seen := make(map[int64]*Comment)
+	for rows.Next() {
+		var comment Comment
+		var siblings int
+		var parentID, authorID sql.NullInt64
+		var authorName sql.NullString
+		// Scan the values from the row into comment
+		err := rows.Scan(
+			&siblings,
+			&comment.Depth,
+			&comment.ID,
+			&comment.CreatedAt,
+			&comment.PostID,
+			&parentID,
+			&authorID,
+			&authorName,
+			&comment.Content,
+			&comment.Version,
+			&comment.LikeCount,
+			&comment.LikedByMe,
+			&comment.ReplyCount,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		comment.ParentID = parentID.Int64
+		comment.UserID = authorID.Int64
+		comment.Author = newAuthor(authorID, authorName)
+		// Roots of the page go in the listing, everything else under its parent
+		if comment.Depth == 0 {
+			totalRecords = siblings
+			comments = append(comments, &comment)
+		} else {
+			// A reply whose parent was not returned has nowhere to go
+			parent, ok := seen[comment.ParentID]
+			if !ok {
+				continue
+			}
+			parent.Replies = append(parent.Replies, &comment)
+		}
+		seen[comment.ID] = &comment
+	}
+	// Check for errors after looping through the resultset
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	// Return the top of the tree
+	return comments, metadata, nil
+}
@@ -0,0 +1,203 @@
+// Filename: internal/data/exports.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The states an export goes through
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+)
+
+// An export that has been running for longer than this is assumed to have
+// been interrupted, for example by a restart, and is picked up again
+const exportStaleAfter = time.Hour
+
+// The Export type is a request of a user for a copy of their personal data
+type Export struct {
+	ID          int64      `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UserID      int64      `json:"-"`
+	Status      string     `json:"status"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Path        string     `json:"-"`
+}
+
+// Define an ExportModel which wraps a sql.DB connection pool
+type ExportModel struct {
+	DB *sql.DB
+}
+
+// Insert() queues an export for a user. While one is already queued or
+// running no other is added and ok is false
+func (m ExportModel) Insert(userID int64) (bool, error) {
+	query := `
+		INSERT INTO exports (user_id)
+		SELECT $1
+		WHERE NOT EXISTS (
+			SELECT 1 FROM exports
+			WHERE user_id = $1 AND status IN ('pending', 'running')
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+// Claim() marks the oldest queued export as running and returns it. Rows are
+// locked with SKIP LOCKED so several api instances can share the queue.
+// ErrRecordNotFound means there is nothing to do
+func (m ExportModel) Claim() (*Export, error) {
+	query := `
+		UPDATE exports
+		SET status = 'running', started_at = NOW()
+		WHERE id = (
+			SELECT id FROM exports
+			WHERE status = 'pending'
+			OR (status = 'running' AND started_at < $1)
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, user_id, status
+	`
+	var export Export
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, time.Now().Add(-exportStaleAfter)).Scan(
+		&export.ID,
+		&export.CreatedAt,
+		&export.UserID,
+		&export.Status,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &export, nil
+}
+
+// Complete() records where the finished archive of an export is stored. The
+// export is gone if its user was anonymized while it was being built
+func (m ExportModel) Complete(export *Export) error {
+	query := `
+		UPDATE exports
+		SET status = 'done', completed_at = NOW(), path = $2
+		WHERE id = $1
+		RETURNING status, completed_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, export.ID, export.Path).Scan(&export.Status, &export.CompletedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Fail() marks an export that could not be built
+func (m ExportModel) Fail(id int64) error {
+	query := `
+		UPDATE exports
+		SET status = 'failed', completed_at = NOW()
+		WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// GetLatestForUser() returns the most recent finished export of a user
+func (m ExportModel) GetLatestForUser(userID int64) (*Export, error) {
+	query := `
+		SELECT id, created_at, user_id, status, completed_at, path
+		FROM exports
+		WHERE user_id = $1 AND status = 'done'
+		ORDER BY id DESC
+		LIMIT 1
+	`
+	var export Export
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&export.ID,
+		&export.CreatedAt,
+		&export.UserID,
+		&export.Status,
+		&export.CompletedAt,
+		&export.Path,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &export, nil
+}
+
+// DeleteFinishedBefore() removes the exports that were completed before the
+// cutoff and returns the paths of their archives so they can be removed too
+func (m ExportModel) DeleteFinishedBefore(cutoff time.Time) ([]string, error) {
+	query := `
+		DELETE FROM exports
+		WHERE status IN ('done', 'failed') AND completed_at < $1
+		RETURNING path
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	paths := []string{}
+	for rows.Next() {
+		var path string
+		err := rows.Scan(&path)
+		if err != nil {
+			return nil, err
+		}
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
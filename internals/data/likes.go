@@ -0,0 +1,115 @@
+// Filename: internal/data/likes.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// The Like type is a post or comment liked by a user
+type Like struct {
+	Type      string    `json:"type"`
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Define a LikeModel which wraps a sql.DB connection pool
+type LikeModel struct {
+	DB *sql.DB
+}
+
+// LikePost() records that a user likes a post. Liking twice is not an error.
+// The post's like count and hot score only move when a like is added
+func (m LikeModel) LikePost(userID, postID int64) error {
+	query := `
+		WITH liked AS (
+			INSERT INTO likedpost (users_id, posts_id)
+			VALUES ($1, $2)
+			ON CONFLICT (users_id, posts_id) DO NOTHING
+			RETURNING posts_id
+		)
+		UPDATE posts
+		SET like_count = like_count + 1,
+		hot_score = LOG(GREATEST(like_count + 1, 1)) + EXTRACT(EPOCH FROM created_at) / 45000,
+		last_activity_at = NOW()
+		WHERE id IN (SELECT posts_id FROM liked)
+	`
+	return m.exec(query, userID, postID)
+}
+
+// UnlikePost() removes the like of a user from a post, if there is one
+func (m LikeModel) UnlikePost(userID, postID int64) error {
+	query := `
+		WITH unliked AS (
+			DELETE FROM likedpost
+			WHERE users_id = $1 AND posts_id = $2
+			RETURNING posts_id
+		)
+		UPDATE posts
+		SET like_count = like_count - 1,
+		hot_score = LOG(GREATEST(like_count - 1, 1)) + EXTRACT(EPOCH FROM created_at) / 45000
+		WHERE id IN (SELECT posts_id FROM unliked)
+	`
+	return m.exec(query, userID, postID)
+}
+
+// LikeComment() records that a user likes a comment. Liking twice is not an error
+func (m LikeModel) LikeComment(userID, commentID int64) error {
+	query := `
+		INSERT INTO likedcomment (users_id, comments_id)
+		VALUES ($1, $2)
+		ON CONFLICT (users_id, comments_id) DO NOTHING
+	`
+	return m.exec(query, userID, commentID)
+}
+
+// UnlikeComment() removes the like of a user from a comment, if there is one
+func (m LikeModel) UnlikeComment(userID, commentID int64) error {
+	query := `
+		DELETE FROM likedcomment
+		WHERE users_id = $1 AND comments_id = $2
+	`
+	return m.exec(query, userID, commentID)
+}
+
+// GetAllForUser() returns the posts and comments a user likes, oldest first
+func (m LikeModel) GetAllForUser(userID int64) ([]*Like, error) {
+	query := `
+		SELECT 'post', posts_id, created_at FROM likedpost WHERE users_id = $1
+		UNION ALL
+		SELECT 'comment', comments_id, created_at FROM likedcomment WHERE users_id = $1
+		ORDER BY 3, 1, 2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	likes := []*Like{}
+	for rows.Next() {
+		var like Like
+		err := rows.Scan(&like.Type, &like.ID, &like.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		likes = append(likes, &like)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return likes, nil
+}
+
+// exec() runs a like statement with the usual 3-second timeout
+func (m LikeModel) exec(query string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
@@ -5,6 +5,7 @@ package data
 import (
 	"errors"
 	"database/sql"
+	"time"
 )
 
 var (
@@ -15,19 +16,44 @@ var (
 // a wrapper for our data models
 type Models struct {
 	Permissions PermissionModel
+	Roles RoleModel
 	Forums ForumModel
 	Comments CommentModel
+	Likes LikeModel
 	Users UserModel
 	Tokens TokenModel
+	Exports ExportModel
+	TwoFactor TwoFactorModel
+	LoginThrottles LoginThrottleModel
+	APITokens APITokenModel
+	OAuthClients OAuthClientModel
+	OAuthCodes OAuthCodeModel
+	Categories CategoryModel
+	Tags TagModel
 }
 
-//NewModels allows us to create a new model
-func NewModels(db *sql.DB) Models {
+//NewModels allows us to create a new model. Permissions are cached for
+//permissionCacheTTL, zero turns the cache off
+func NewModels(db *sql.DB, permissionCacheTTL time.Duration) Models {
+	var cache *PermissionCache
+	if permissionCacheTTL > 0 {
+		cache = NewPermissionCache(permissionCacheTTL)
+	}
 	return Models {
 		Forums: ForumModel{DB: db},
 		Comments: CommentModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Likes: LikeModel{DB: db},
+		Permissions: PermissionModel{DB: db, Cache: cache},
+		Roles: RoleModel{DB: db, Cache: cache},
 		Users: UserModel{DB: db},
 		Tokens: TokenModel{DB: db},
+		Exports: ExportModel{DB: db},
+		TwoFactor: TwoFactorModel{DB: db},
+		LoginThrottles: LoginThrottleModel{DB: db},
+		APITokens: APITokenModel{DB: db},
+		OAuthClients: OAuthClientModel{DB: db},
+		OAuthCodes: OAuthCodeModel{DB: db},
+		Categories: CategoryModel{DB: db},
+		Tags: TagModel{DB: db},
 	}
 }
\ No newline at end of file
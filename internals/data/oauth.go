@@ -0,0 +1,321 @@
+// Filename: internal/data/oauth.go
+
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"regexp"
+	"time"
+
+	"forum.castillojadah.net/internals/validator"
+	"github.com/lib/pq"
+)
+
+// The characters RFC 7636 allows in a PKCE code verifier
+var codeVerifierRX = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// The OAuthClient type is a third-party app registered by a user
+type OAuthClient struct {
+	ID           int64       `json:"id"`
+	CreatedAt    time.Time   `json:"created_at"`
+	UserID       int64       `json:"-"`
+	ClientID     string      `json:"client_id"`
+	Secret       string      `json:"client_secret,omitempty"`
+	SecretHash   []byte      `json:"-"`
+	Confidential bool        `json:"confidential"`
+	Name         string      `json:"name"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"`
+}
+
+// SecretMatches() checks the secret a confidential client authenticates with
+func (c *OAuthClient) SecretMatches(secret string) bool {
+	if c.SecretHash == nil || secret == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+// HasRedirectURI() reports whether uri is one of the registered redirect
+// URIs. Only exact matches count
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(client.RedirectURIs) > 0, "redirect_uris", "must contain at least 1 uri")
+	v.Check(len(client.RedirectURIs) <= 5, "redirect_uris", "must not contain more than 5 uris")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	for _, uri := range client.RedirectURIs {
+		v.Check(validRedirectURI(uri), "redirect_uris", "must be absolute https uris without a fragment, or http on localhost")
+	}
+	v.Check(len(client.Scopes) > 0, "scopes", "must contain at least 1 permission")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+}
+
+// The validRedirectURI() function only accepts https, except on the local
+// machine where apps under development run on plain http
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return false
+	}
+}
+
+// Check a PKCE code verifier against the S256 challenge sent with the
+// authorization request
+func VerifyCodeChallenge(challenge, verifier string) bool {
+	if !codeVerifierRX.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// Define an OAuthClientModel which wraps a sql.DB connection pool
+type OAuthClientModel struct {
+	DB *sql.DB
+}
+
+// Insert() registers a client, generating its id and, for confidential
+// clients, the secret that is only returned now
+func (m OAuthClientModel) Insert(client *OAuthClient) error {
+	clientID, err := generateToken(client.UserID, 0, "")
+	if err != nil {
+		return err
+	}
+	client.ClientID = clientID.Plaintext
+	if client.Confidential {
+		secret, err := generateToken(client.UserID, 0, "")
+		if err != nil {
+			return err
+		}
+		client.Secret = secret.Plaintext
+		client.SecretHash = secret.Hash
+	}
+	query := `
+		INSERT INTO oauth_clients (user_id, client_id, secret_hash, name, redirect_uris, scopes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+	args := []interface{}{
+		client.UserID,
+		client.ClientID,
+		client.SecretHash,
+		client.Name,
+		pq.Array(client.RedirectURIs),
+		pq.Array(client.Scopes),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.ID, &client.CreatedAt)
+}
+
+// GetByClientID() returns the client with the given public client id
+func (m OAuthClientModel) GetByClientID(clientID string) (*OAuthClient, error) {
+	query := `
+		SELECT id, created_at, user_id, client_id, secret_hash, name, redirect_uris, scopes
+		FROM oauth_clients
+		WHERE client_id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	clients, err := m.list(ctx, query, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return clients[0], nil
+}
+
+// GetAllForUser() returns the clients a user registered, newest first
+func (m OAuthClientModel) GetAllForUser(userID int64) ([]*OAuthClient, error) {
+	query := `
+		SELECT id, created_at, user_id, client_id, secret_hash, name, redirect_uris, scopes
+		FROM oauth_clients
+		WHERE user_id = $1
+		ORDER BY id DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.list(ctx, query, userID)
+}
+
+// Delete() removes a client of a user together with its codes and tokens
+func (m OAuthClientModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+		DELETE FROM oauth_clients
+		WHERE id = $1 AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// The list() method runs a client query and scans the resultset
+func (m OAuthClientModel) list(ctx context.Context, query string, args ...interface{}) ([]*OAuthClient, error) {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		var client OAuthClient
+		err := rows.Scan(
+			&client.ID,
+			&client.CreatedAt,
+			&client.UserID,
+			&client.ClientID,
+			&client.SecretHash,
+			&client.Name,
+			pq.Array(&client.RedirectURIs),
+			pq.Array(&client.Scopes),
+		)
+		if err != nil {
+			return nil, err
+		}
+		client.Confidential = client.SecretHash != nil
+		clients = append(clients, &client)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// The OAuthCode type is an authorization code handed to a client through
+// the user's browser
+type OAuthCode struct {
+	Plaintext     string
+	ClientID      int64
+	UserID        int64
+	RedirectURI   string
+	Scopes        Permissions
+	CodeChallenge string
+}
+
+// Define an OAuthCodeModel which wraps a sql.DB connection pool
+type OAuthCodeModel struct {
+	DB *sql.DB
+}
+
+// New() stores an authorization code that can be exchanged once within ttl
+// and fills in its plaintext
+func (m OAuthCodeModel) New(code *OAuthCode, ttl time.Duration) error {
+	token, err := generateToken(code.UserID, ttl, "")
+	if err != nil {
+		return err
+	}
+	code.Plaintext = token.Plaintext
+	query := `
+		INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	args := []interface{}{
+		token.Hash,
+		code.ClientID,
+		code.UserID,
+		code.RedirectURI,
+		pq.Array(code.Scopes),
+		code.CodeChallenge,
+		token.Expiry,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Consume() deletes the unexpired code of a client and returns it, so a code
+// can never be exchanged twice
+func (m OAuthCodeModel) Consume(plaintext string, clientID int64) (*OAuthCode, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+		DELETE FROM oauth_codes
+		WHERE hash = $1 AND client_id = $2
+		RETURNING user_id, redirect_uri, scopes, code_challenge, expiry > NOW()
+	`
+	code := OAuthCode{Plaintext: plaintext, ClientID: clientID}
+	var unexpired bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash[:], clientID).Scan(
+		&code.UserID,
+		&code.RedirectURI,
+		pq.Array(&code.Scopes),
+		&code.CodeChallenge,
+		&unexpired,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if !unexpired {
+		return nil, ErrRecordNotFound
+	}
+	return &code, nil
+}
+
+// DeleteExpired() removes the codes that were never exchanged
+func (m OAuthCodeModel) DeleteExpired() (int64, error) {
+	query := `
+		DELETE FROM oauth_codes
+		WHERE expiry < NOW()
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,176 @@
+// Filename: internal/data/oauth_test.go
+
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// s256() derives the S256 code challenge of a verifier
+func s256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge string
+		verifier  string
+		want      bool
+	}{
+		// RFC 7636 appendix B
+		{"rfc example", "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", true},
+		{"wrong verifier", "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXK", false},
+		{"plain challenge", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", false},
+		{"empty challenge", "", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", false},
+		{"empty verifier", s256(""), "", false},
+		{"shortest verifier", s256(strings.Repeat("a", 43)), strings.Repeat("a", 43), true},
+		{"verifier too short", s256(strings.Repeat("a", 42)), strings.Repeat("a", 42), false},
+		{"longest verifier", s256(strings.Repeat("a", 128)), strings.Repeat("a", 128), true},
+		{"verifier too long", s256(strings.Repeat("a", 129)), strings.Repeat("a", 129), false},
+		{"verifier with invalid characters", s256(strings.Repeat("a+", 22)), strings.Repeat("a+", 22), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyCodeChallenge(tt.challenge, tt.verifier); got != tt.want {
+				t.Fatalf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidRedirectURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want bool
+	}{
+		{"https://example.com/callback", true},
+		{"https://example.com:8443/callback?app=forum", true},
+		{"http://localhost:8080/callback", true},
+		{"http://127.0.0.1/callback", true},
+		{"http://[::1]:3000/callback", true},
+		{"http://example.com/callback", false},
+		{"http://localhost.example.com/callback", false},
+		{"https://example.com/callback#token", false},
+		{"https:///callback", false},
+		{"/callback", false},
+		{"forum://callback", false},
+		{"javascript:alert(1)", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			if got := validRedirectURI(tt.uri); got != tt.want {
+				t.Fatalf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasRedirectURI(t *testing.T) {
+	client := &OAuthClient{
+		RedirectURIs: []string{"https://example.com/callback", "http://localhost:8080/callback"},
+	}
+	tests := []struct {
+		uri  string
+		want bool
+	}{
+		{"https://example.com/callback", true},
+		{"http://localhost:8080/callback", true},
+		{"https://example.com/callback/", false},
+		{"https://example.com/Callback", false},
+		{"https://example.com/callback?next=/admin", false},
+		{"https://example.com", false},
+		{"http://localhost:8081/callback", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			if got := client.HasRedirectURI(tt.uri); got != tt.want {
+				t.Fatalf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOAuthCodeConsume(t *testing.T) {
+	db := newTestDB(t)
+	// A code needs nothing of its user but the row
+	var userID int64
+	username := fmt.Sprintf("test%d", time.Now().UnixNano())
+	err := db.QueryRow(`
+		INSERT INTO users (username, email, password_hash, activated)
+		VALUES ($1, $1 || '@example.com', '', true)
+		RETURNING id
+	`, username).Scan(&userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM users WHERE id = $1`, userID) })
+
+	client := &OAuthClient{
+		UserID:       userID,
+		Name:         "test",
+		RedirectURIs: []string{"https://example.com/callback"},
+		Scopes:       Permissions{"forums:read"},
+	}
+	err = OAuthClientModel{DB: db}.Insert(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := OAuthCodeModel{DB: db}
+	newCode := func(ttl time.Duration) *OAuthCode {
+		code := &OAuthCode{
+			ClientID:      client.ID,
+			UserID:        userID,
+			RedirectURI:   client.RedirectURIs[0],
+			Scopes:        client.Scopes,
+			CodeChallenge: s256(strings.Repeat("a", 43)),
+		}
+		err := codes.New(code, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	code := newCode(time.Minute)
+	expired := newCode(-time.Minute)
+
+	// The steps run in order, each one sees what the ones before it did
+	tests := []struct {
+		name      string
+		plaintext string
+		clientID  int64
+		wantErr   error
+	}{
+		{"other client", code.Plaintext, client.ID + 1, ErrRecordNotFound},
+		{"first exchange", code.Plaintext, client.ID, nil},
+		{"second exchange", code.Plaintext, client.ID, ErrRecordNotFound},
+		{"expired code", expired.Plaintext, client.ID, ErrRecordNotFound},
+		{"unknown code", "AAAAAAAAAAAAAAAAAAAAAAAAAA", client.ID, ErrRecordNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := codes.Consume(tt.plaintext, tt.clientID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.UserID != userID || got.RedirectURI != code.RedirectURI || got.CodeChallenge != code.CodeChallenge {
+				t.Fatalf("got %+v; want %+v", got, code)
+			}
+			if strings.Join(got.Scopes, " ") != strings.Join(code.Scopes, " ") {
+				t.Fatalf("got scopes %v; want %v", got.Scopes, code.Scopes)
+			}
+		})
+	}
+}
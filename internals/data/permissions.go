@@ -22,19 +22,60 @@ func (p Permissions) Include(code string) bool {
 	return false
 }
 
+// Returns the codes that are in both slices
+func (p Permissions) Intersect(other Permissions) Permissions {
+	var codes Permissions
+	for _, code := range p {
+		if other.Include(code) {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// The AuditEntry type records a single grant or revocation of a permission
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ActorID   *int64    `json:"actor_id"`
+	UserID    *int64    `json:"user_id"`
+	Code      string    `json:"code"`
+	Action    string    `json:"action"`
+}
+
 type PermissionModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *PermissionCache
 }
 
+// GetAllForUser() returns the permissions granted to a user directly
+// together with the ones bundled in the user's roles, less the ones taken
+// away from the user. Results are cached when the model has a cache
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	// Serve the permissions from the cache when we have them
+	if permissions, found := m.Cache.Get(userID); found {
+		return permissions, nil
+	}
 	query := `
 	     SELECT permissions.code
 		 FROM permissions
 		 INNER JOIN users_permissions
 		 ON users_permissions.permission_id = permissions.id
-		 INNER JOIN users
-		 ON users_permissions.user_id = users.id
-		 WHERE users.id = $1
+		 WHERE users_permissions.user_id = $1
+		 UNION
+		 SELECT permissions.code
+		 FROM permissions
+		 INNER JOIN roles_permissions
+		 ON roles_permissions.permission_id = permissions.id
+		 INNER JOIN user_roles
+		 ON user_roles.role_id = roles_permissions.role_id
+		 WHERE user_roles.user_id = $1
+		 EXCEPT
+		 SELECT permissions.code
+		 FROM permissions
+		 INNER JOIN users_permissions_denied
+		 ON users_permissions_denied.permission_id = permissions.id
+		 WHERE users_permissions_denied.user_id = $1
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -56,6 +97,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
+	m.Cache.Set(userID, permisisons)
 	return permisisons, nil
 }
 
@@ -68,5 +110,179 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	m.Cache.Invalidate(userID)
 	return err
-}
\ No newline at end of file
+}
+
+// Missing() returns the codes that do not exist in the permissions table
+func (m PermissionModel) Missing(codes ...string) ([]string, error) {
+	query := `
+		SELECT code
+		FROM unnest($1::text[]) AS code
+		WHERE code NOT IN (SELECT permissions.code FROM permissions)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(codes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var missing []string
+	for rows.Next() {
+		var code string
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, code)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
+
+// ListAll() returns every permission code that exists
+func (m PermissionModel) ListAll() (Permissions, error) {
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// GrantForUser() gives a user a permission on behalf of actorID, lifting a
+// revocation of it if there is one. The change and its audit entry are
+// written in one transaction, and granting a permission the user already
+// holds changes nothing
+func (m PermissionModel) GrantForUser(actorID, userID int64, code string) error {
+	queries := []string{
+		`DELETE FROM users_permissions_denied
+		WHERE user_id = $1
+		AND permission_id = (SELECT permissions.id FROM permissions WHERE permissions.code = $2)`,
+		`INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = $2
+		ON CONFLICT DO NOTHING`,
+	}
+	return m.change(actorID, userID, code, "grant", queries)
+}
+
+// RemoveForUser() takes a permission away from a user on behalf of actorID
+// and audits it. A direct grant is removed, and when one of the user's roles
+// grants the permission too it is denied to the user, so that the user no
+// longer has it either way
+func (m PermissionModel) RemoveForUser(actorID, userID int64, code string) error {
+	queries := []string{
+		`DELETE FROM users_permissions
+		WHERE user_id = $1
+		AND permission_id = (SELECT permissions.id FROM permissions WHERE permissions.code = $2)`,
+		`INSERT INTO users_permissions_denied
+		SELECT DISTINCT $1::bigint, roles_permissions.permission_id
+		FROM roles_permissions
+		INNER JOIN user_roles ON user_roles.role_id = roles_permissions.role_id
+		INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+		WHERE user_roles.user_id = $1 AND permissions.code = $2
+		ON CONFLICT DO NOTHING`,
+	}
+	return m.change(actorID, userID, code, "revoke", queries)
+}
+
+// The change() method runs the queries of a grant or revocation in a
+// transaction and writes the audit entry when any of them changed a row
+func (m PermissionModel) change(actorID, userID int64, code, action string, queries []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	var changed int64
+	for _, query := range queries {
+		result, err := tx.ExecContext(ctx, query, userID, code)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		changed += rowsAffected
+	}
+	if changed > 0 {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO permissions_audit (actor_id, user_id, code, action)
+			VALUES ($1, $2, $3, $4)
+		`, actorID, userID, code, action)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	m.Cache.Invalidate(userID)
+	return err
+}
+
+// GetAuditForUser() returns the permission changes made to a user, newest first
+func (m PermissionModel) GetAuditForUser(userID int64) ([]*AuditEntry, error) {
+	query := `
+		SELECT id, created_at, actor_id, user_id, code, action
+		FROM permissions_audit
+		WHERE user_id = $1
+		ORDER BY id DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.ActorID,
+			&entry.UserID,
+			&entry.Code,
+			&entry.Action,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
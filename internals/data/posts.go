@@ -8,14 +8,21 @@ import (
 	"time"
 
 	"forum.castillojadah.net/internals/validator"
+	"github.com/lib/pq"
 )
 
 type Forum struct {
 	ID         int64     `json:"id"`
 	CreatedAt  time.Time `json:"-"`
+	UserID     int64     `json:"-"`
+	Author     *Author   `json:"author,omitempty"`
+	CategoryID *int64    `json:"category_id"`
+	Tags       []string  `json:"tags"`
 	Title      string    `json:"title"`
 	Content    string    `json:"content"`
 	Version    int32     `json:"version"`
+	LikeCount  int       `json:"like_count"`
+	LikedByMe  bool      `json:"liked_by_me"`
 }
 
 func ValidateForum(v *validator.Validator, forum *Forum) {
@@ -25,8 +32,26 @@ func ValidateForum(v *validator.Validator, forum *Forum) {
 
 	v.Check(forum.Content != "", "Content", "must be provided")
 	v.Check(len(forum.Content) <= 600, "Content", "must not be more than 300 bytes long")
+
+	ValidateTags(v, forum.Tags)
+}
+
+// The listing periods accepted by the t query parameter and how far back
+// each one reaches. A zero duration means no limit
+var Periods = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"all":   0,
 }
 
+// The tags of a forum as an array column, in alphabetical order
+const forumTagsColumn = `ARRAY(
+		SELECT tags.name FROM posts_tags
+		INNER JOIN tags ON tags.id = posts_tags.tag_id
+		WHERE posts_tags.post_id = posts.id
+		ORDER BY tags.name)`
+
 // Define a ForumModel which wraps a sql.DB connection pool
 type ForumModel struct {
 	DB *sql.DB
@@ -35,35 +60,67 @@ type ForumModel struct {
 // Insert() allows us  to create a new Forum
 func (m ForumModel) Insert(forum *Forum) error {
 	query := `
-		INSERT INTO posts (title, content)
-		VALUES ($1, $2)
+		INSERT INTO posts (user_id, title, content, category_id, hot_score)
+		VALUES ($1, $2, $3, $4, EXTRACT(EPOCH FROM NOW()) / 45000)
 		RETURNING id, created_at, version
 	`
 	// Collect the data fields into a slice
 	args := []interface{}{
-		forum.Title, forum.Content,
+		forum.UserID, forum.Title, forum.Content, forum.CategoryID,
 	}
 	// Create a context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	// Cleanup to prevent memory leaks
 	defer cancel()
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&forum.ID, &forum.CreatedAt, &forum.Version)
+	// The forum and its tags are written together
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&forum.ID, &forum.CreatedAt, &forum.Version)
+	if err != nil {
+		return forumError(err)
+	}
+	err = setTags(ctx, tx, forum.ID, forum.Tags)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// forumError() maps the constraint violations of a forum write
+func forumError(err error) error {
+	switch {
+	case err.Error() == `pq: insert or update on table "posts" violates foreign key constraint "posts_category_id_fkey"`:
+		return ErrUnknownCategory
+	default:
+		return err
+	}
 }
 
-// Get() allows us to retrieve a specific Forum
-func (m ForumModel) Get(id int64) (*Forum, error) {
+// Get() allows us to retrieve a specific Forum as seen by userID
+func (m ForumModel) Get(id int64, userID int64) (*Forum, error) {
 	// Ensure that there is a valid id
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	// Create the query
 	query := `
-		SELECT id, created_at, title, content, version
+		SELECT posts.id, posts.created_at, posts.user_id, users.username,
+		posts.category_id, posts.title, posts.content, posts.version,
+		posts.like_count, ` + forumTagsColumn + `,
+		EXISTS(SELECT 1 FROM likedpost WHERE likedpost.posts_id = posts.id AND likedpost.users_id = $2)
 		FROM posts
-		WHERE id = $1
+		LEFT JOIN users ON users.id = posts.user_id
+		WHERE posts.id = $1
 	`
 	// Declare a Forum variable to hold the returned data
 	var forum Forum
+	var authorID sql.NullInt64
+	var authorName sql.NullString
+	var categoryID sql.NullInt64
 
 	// Create a context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -71,12 +128,18 @@ func (m ForumModel) Get(id int64) (*Forum, error) {
 	defer cancel()
 
 	// Execute the query using QueryRow()
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
 		&forum.ID,
 		&forum.CreatedAt,
+		&authorID,
+		&authorName,
+		&categoryID,
 		&forum.Title,
 		&forum.Content,
 		&forum.Version,
+		&forum.LikeCount,
+		pq.Array(&forum.Tags),
+		&forum.LikedByMe,
 	)
 	// Handle any errors
 	if err != nil {
@@ -88,6 +151,9 @@ func (m ForumModel) Get(id int64) (*Forum, error) {
 			return nil, err
 		}
 	}
+	forum.UserID = authorID.Int64
+	forum.Author = newAuthor(authorID, authorName)
+	forum.CategoryID = nullableID(categoryID)
 	// Success
 	return &forum, nil
 }
@@ -98,14 +164,15 @@ func (m ForumModel) Update(forum *Forum) error {
 	// Create a query
 	query := `
 		UPDATE posts
-		SET title = $1, content = $2, version = version + 1
-		WHERE id = $3
-		AND version = $4
+		SET title = $1, content = $2, category_id = $3, last_activity_at = NOW(), version = version + 1
+		WHERE id = $4
+		AND version = $5
 		RETURNING version
 	`
 	args := []interface{}{
 		forum.Title,
 		forum.Content,
+		forum.CategoryID,
 		forum.ID,
 		forum.Version,
 	}
@@ -114,17 +181,27 @@ func (m ForumModel) Update(forum *Forum) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	// Cleanup to prevent memory leaks
 	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
 	// Check for edit conflicts
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&forum.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&forum.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return forumError(err)
 		}
 	}
-	return nil
+	err = setTags(ctx, tx, forum.ID, forum.Tags)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Delete() removes a specific Forum
@@ -162,24 +239,44 @@ func (m ForumModel) Delete(id int64) error {
 	return nil
 }
 
-// The GetAll() method retuns a list of all the forums sorted by id
-func (m ForumModel) GetAll(title string, content string, filters Filters) ([]*Forum, Metadata, error) {
+// The GetAll() method retuns a list of all the forums created within period
+// sorted by the filters, with the likes of userID marked. A categoryID other
+// than zero only lists the forums filed under that category. When tags are
+// given the forums need at least one of them, or all of them if matchAll is
+// set. The tags must be normalized and unique
+func (m ForumModel) GetAll(title string, content string, period string, categoryID int64, tags []string, matchAll bool, userID int64, filters Filters) ([]*Forum, Metadata, error) {
+	// Work out the oldest forum to include
+	var since time.Time
+	if Periods[period] > 0 {
+		since = time.Now().Add(-Periods[period])
+	}
 
 	// Construct the query
 
 	query := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), id, created_at, title, content, version
+		SELECT COUNT(*) OVER(), posts.id, posts.created_at, posts.user_id, users.username,
+		posts.category_id, posts.title, posts.content, posts.version,
+		posts.like_count, ` + forumTagsColumn + `,
+		EXISTS(SELECT 1 FROM likedpost WHERE likedpost.posts_id = posts.id AND likedpost.users_id = $5)
 		FROM posts
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (to_tsvector('simple', content) @@ plainto_tsquery('simple', $2) OR $2 = '')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortOrder())
+		LEFT JOIN users ON users.id = posts.user_id
+		WHERE (to_tsvector('simple', posts.title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND (to_tsvector('simple', posts.content) @@ plainto_tsquery('simple', $2) OR $2 = '')
+		AND posts.created_at >= $6
+		AND (posts.category_id = $7 OR $7 = 0)
+		AND (cardinality($8::text[]) = 0 OR (
+			SELECT COUNT(*) FROM posts_tags
+			INNER JOIN tags ON tags.id = posts_tags.tag_id
+			WHERE posts_tags.post_id = posts.id AND tags.name = ANY($8)
+		) >= CASE WHEN $9 THEN cardinality($8::text[]) ELSE 1 END)
+		ORDER BY %s
+		LIMIT $3 OFFSET $4`, forumOrderBy(filters))
 
 	// Create a 3-second-timout context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	// Execute the query
-	args := []interface{}{title, content, filters.limit(), filters.offset()}
+	args := []interface{}{title, content, filters.limit(), filters.offset(), userID, since, categoryID, pq.Array(tags), matchAll}
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -192,18 +289,30 @@ func (m ForumModel) GetAll(title string, content string, filters Filters) ([]*Fo
 	// Iterate over the rows in the resultset
 	for rows.Next() {
 		var forum Forum
+		var authorID sql.NullInt64
+		var authorName sql.NullString
+		var categoryID sql.NullInt64
 		// Scan the values from the row into forum
 		err := rows.Scan(
 			&totalRecords,
 			&forum.ID,
 			&forum.CreatedAt,
+			&authorID,
+			&authorName,
+			&categoryID,
 			&forum.Title,
 			&forum.Content,
 			&forum.Version,
+			&forum.LikeCount,
+			pq.Array(&forum.Tags),
+			&forum.LikedByMe,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
+		forum.UserID = authorID.Int64
+		forum.Author = newAuthor(authorID, authorName)
+		forum.CategoryID = nullableID(categoryID)
 		// Add the Forum to our slice
 		forums = append(forums, &forum)
 	}
@@ -214,4 +323,75 @@ func (m ForumModel) GetAll(title string, content string, filters Filters) ([]*Fo
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 	// Return the slice of Forums
 	return forums, metadata, nil
-}
\ No newline at end of file
+}
+
+// The GetAllByAuthor() method returns every forum written by a user, oldest
+// first, for their personal data export
+func (m ForumModel) GetAllByAuthor(userID int64) ([]*Forum, error) {
+	query := `
+		SELECT posts.id, posts.created_at, posts.user_id, users.username,
+		posts.category_id, posts.title, posts.content, posts.version,
+		posts.like_count, ` + forumTagsColumn + `,
+		EXISTS(SELECT 1 FROM likedpost WHERE likedpost.posts_id = posts.id AND likedpost.users_id = $1)
+		FROM posts
+		LEFT JOIN users ON users.id = posts.user_id
+		WHERE posts.user_id = $1
+		ORDER BY posts.id ASC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	forums := []*Forum{}
+	for rows.Next() {
+		var forum Forum
+		var authorID sql.NullInt64
+		var authorName sql.NullString
+		var categoryID sql.NullInt64
+		err := rows.Scan(
+			&forum.ID,
+			&forum.CreatedAt,
+			&authorID,
+			&authorName,
+			&categoryID,
+			&forum.Title,
+			&forum.Content,
+			&forum.Version,
+			&forum.LikeCount,
+			pq.Array(&forum.Tags),
+			&forum.LikedByMe,
+		)
+		if err != nil {
+			return nil, err
+		}
+		forum.UserID = authorID.Int64
+		forum.Author = newAuthor(authorID, authorName)
+		forum.CategoryID = nullableID(categoryID)
+		forums = append(forums, &forum)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return forums, nil
+}
+
+// The forumOrderBy() function builds the ORDER BY clause for a forum listing.
+// The ranking modes read the columns kept up to date by the model so each one
+// is served by its own index on posts
+func forumOrderBy(filters Filters) string {
+	switch filters.sortColumn() {
+	case "hot":
+		return "posts.hot_score DESC, posts.id DESC"
+	case "top":
+		return "posts.like_count DESC, posts.id DESC"
+	case "active":
+		return "posts.last_activity_at DESC, posts.id DESC"
+	case "new":
+		return "posts.created_at DESC, posts.id DESC"
+	default:
+		return fmt.Sprintf("posts.%s %s, posts.id ASC", filters.sortColumn(), filters.sortOrder())
+	}
+}
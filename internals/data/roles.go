@@ -0,0 +1,74 @@
+// Filename: internal/data/roles.go
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The roles every installation starts with
+const (
+	RoleMember    = "member"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Define a slice to hold the role names
+type Roles []string
+
+type RoleModel struct {
+	DB    *sql.DB
+	Cache *PermissionCache
+}
+
+// GetAllForUser() returns the names of the roles held by a user
+func (m RoleModel) GetAllForUser(userID int64) (Roles, error) {
+	query := `
+		SELECT roles.name
+		FROM roles
+		INNER JOIN user_roles
+		ON user_roles.role_id = roles.id
+		WHERE user_roles.user_id = $1
+		ORDER BY roles.name
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := Roles{}
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// AddForUser() gives a user the named roles. Roles they already hold are skipped
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	query := `
+		INSERT INTO user_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	// The user's permissions change with their roles
+	m.Cache.Invalidate(userID)
+	return err
+}
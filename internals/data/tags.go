@@ -0,0 +1,127 @@
+// Filename: internal/data/tags.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"forum.castillojadah.net/internals/validator"
+	"github.com/lib/pq"
+)
+
+// MaxTags is the most tags a forum can have
+const MaxTags = 5
+
+// Tags are lowercase and may keep the punctuation of names like c++, c# or
+// node.js, but no spaces
+var TagRX = regexp.MustCompile(`^[a-z0-9][a-z0-9+#.-]*$`)
+
+// The Tag type is a tag together with the number of forums using it
+type Tag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// The NormalizeTag() function lowercases a tag and joins its words with
+// hyphens, so that "Web Dev" and "web-dev" are the same tag
+func NormalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+}
+
+// The NormalizeTags() function normalizes every tag in the slice. The result
+// is never nil so that forums without tags show an empty list
+func NormalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		normalized = append(normalized, NormalizeTag(tag))
+	}
+	return normalized
+}
+
+func ValidateTags(v *validator.Validator, tags []string) {
+	v.Check(len(tags) <= MaxTags, "tags", fmt.Sprintf("must not contain more than %d tags", MaxTags))
+	v.Check(validator.Unique(tags), "tags", "must not contain duplicate values")
+	for _, tag := range tags {
+		v.Check(tag != "", "tags", "must not contain empty tags")
+		v.Check(len(tag) <= 30, "tags", "must not contain tags more than 30 bytes long")
+		v.Check(tag == "" || validator.Matches(tag, TagRX), "tags", "must only contain letters, digits and the characters - + # .")
+	}
+}
+
+// setTags() replaces the tags of a forum within tx, creating the tags that
+// do not exist yet
+func setTags(ctx context.Context, tx *sql.Tx, forumID int64, tags []string) error {
+	query := `
+		INSERT INTO tags (name)
+		SELECT unnest($1::text[])
+		ON CONFLICT DO NOTHING
+	`
+	_, err := tx.ExecContext(ctx, query, pq.Array(tags))
+	if err != nil {
+		return err
+	}
+	query = `
+		DELETE FROM posts_tags
+		WHERE post_id = $1
+		AND tag_id NOT IN (SELECT id FROM tags WHERE name = ANY($2))
+	`
+	_, err = tx.ExecContext(ctx, query, forumID, pq.Array(tags))
+	if err != nil {
+		return err
+	}
+	query = `
+		INSERT INTO posts_tags (post_id, tag_id)
+		SELECT $1, id FROM tags WHERE name = ANY($2)
+		ON CONFLICT DO NOTHING
+	`
+	_, err = tx.ExecContext(ctx, query, forumID, pq.Array(tags))
+	return err
+}
+
+// Define a TagModel which wraps a sql.DB connection pool
+type TagModel struct {
+	DB *sql.DB
+}
+
+// The GetAll() method returns the tags in use that start with prefix, with
+// the number of forums using each one. An empty prefix matches every tag
+func (m TagModel) GetAll(prefix string, filters Filters) ([]*Tag, Metadata, error) {
+	// The prefix cannot contain LIKE wildcards since it is a valid tag
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), tags.name, COUNT(*) AS count
+		FROM tags
+		INNER JOIN posts_tags ON posts_tags.tag_id = tags.id
+		WHERE tags.name LIKE $1 || '%%'
+		GROUP BY tags.id
+		ORDER BY %s %s, tags.name ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortOrder())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, prefix, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	tags := []*Tag{}
+	for rows.Next() {
+		var tag Tag
+		err := rows.Scan(&totalRecords, &tag.Name, &tag.Count)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		tags = append(tags, &tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return tags, metadata, nil
+}
@@ -0,0 +1,31 @@
+// Filename: internal/data/testutils_test.go
+
+package data
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// newTestDB() opens the database in FORUM_TEST_DB_DSN, which must have every
+// migration applied. Tests that need it are skipped when the variable is
+// not set
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("FORUM_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("FORUM_TEST_DB_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,154 @@
+// Filename: internal/data/throttles.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LoginEmailKey() returns the throttle key of the account behind an email
+// address. Unknown addresses are tracked the same way so that lockouts do
+// not reveal which accounts exist
+func LoginEmailKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+// LoginIPKey() returns the throttle key of a client address
+func LoginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Define a LoginThrottleModel which wraps a sql.DB connection pool
+type LoginThrottleModel struct {
+	DB *sql.DB
+}
+
+// Reserve() counts a login attempt against every key before the credentials
+// are checked and blocks the keys for backoff(failures), as if the attempt had
+// failed. The rows are locked while this happens so that concurrent attempts
+// cannot slip past a block. If any of the keys is already blocked nothing is
+// counted and the time it is blocked until is returned instead. Failures older
+// than since are forgotten. Release() lifts the block of a successful attempt
+func (m LoginThrottleModel) Reserve(keys []string, since time.Time, backoff func(failures int) time.Duration) (map[string]int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Lock the keys in the same order everywhere so two attempts cannot
+	// deadlock each other
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO login_throttles (key)
+		SELECT unnest($1::text[])
+		ON CONFLICT (key) DO NOTHING
+	`, pq.Array(sorted))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var until sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+		SELECT MAX(blocked_until) FROM (
+			SELECT blocked_until
+			FROM login_throttles
+			WHERE key = ANY($1)
+			ORDER BY key
+			FOR UPDATE
+		) locked
+		WHERE blocked_until > NOW()
+	`, pq.Array(sorted)).Scan(&until)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if until.Valid {
+		return nil, until.Time, nil
+	}
+	failures := make(map[string]int, len(sorted))
+	for _, key := range sorted {
+		var count int
+		err = tx.QueryRowContext(ctx, `
+			UPDATE login_throttles
+			SET failures = CASE
+				WHEN last_failure_at < $2 THEN 1
+				ELSE failures + 1 END,
+			last_failure_at = NOW()
+			WHERE key = $1
+			RETURNING failures
+		`, key, since).Scan(&count)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE login_throttles
+			SET blocked_until = $2
+			WHERE key = $1
+		`, key, time.Now().Add(backoff(count)))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		failures[key] = count
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return failures, time.Time{}, nil
+}
+
+// Release() takes back an attempt counted by Reserve() once it turned out to
+// be successful, lifting the block it put on the keys
+func (m LoginThrottleModel) Release(keys ...string) error {
+	query := `
+		UPDATE login_throttles
+		SET failures = GREATEST(failures - 1, 0), blocked_until = NOW()
+		WHERE key = ANY($1)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(keys))
+	return err
+}
+
+// Reset() forgets the failed logins of the keys, lifting any block
+func (m LoginThrottleModel) Reset(keys ...string) error {
+	query := `
+		DELETE FROM login_throttles
+		WHERE key = ANY($1)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(keys))
+	return err
+}
+
+// DeleteStale() removes the keys that are not blocked and whose last failure
+// is older than before
+func (m LoginThrottleModel) DeleteStale(before time.Time) (int64, error) {
+	query := `
+		DELETE FROM login_throttles
+		WHERE blocked_until < NOW() AND last_failure_at < $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -8,24 +8,57 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
+	"strings"
 	"time"
 
 	"forum.castillojadah.net/internals/validator"
+	"github.com/lib/pq"
 )
 
 // Token categories/scopes
 const (
 	ScopeActivation = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset = "password-reset"
+	ScopeRefresh = "refresh"
+	ScopeEmailChange = "email-change"
+	ScopeExport = "export"
+	ScopeTwoFactorPending = "2fa-pending"
+	ScopeMagicLink = "magic-link"
+	ScopeOAuth = "oauth"
+)
+
+// Access tokens issued to OAuth clients start with this prefix so that
+// authenticate can tell them apart from session tokens
+const OAuthTokenPrefix = "hfo_"
+
+var (
+	ErrTokenReused = errors.New("refresh token reused")
 )
 
 // Define the Token type
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Plaintext   string      `json:"token"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+	Expiry      time.Time   `json:"expiry"`
+	Scope       string      `json:"-"`
+	UserAgent   string      `json:"-"`
+	FamilyID    []byte      `json:"-"`
+	ParentHash  []byte      `json:"-"`
+	ClientID    int64       `json:"-"`
+	Permissions Permissions `json:"-"`
+}
+
+// The Session type describes one of a user's logins without exposing
+// the tokens themselves
+type Session struct {
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
 }
 
 // The generateToken() function returns a Token
@@ -72,22 +105,159 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// Create and insert the tokens of a new login: a short-lived access token
+// and a long-lived refresh token in a new family. The user agent is kept so
+// the user can tell their sessions apart
+func (m TokenModel) NewSession(userID int64, accessTTL, refreshTTL time.Duration, userAgent string) (*Token, *Token, error) {
+	familyID := make([]byte, 16)
+	_, err := rand.Read(familyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	access, refresh, err := m.newSessionTokens(ctx, tx, userID, familyID, nil, accessTTL, refreshTTL, userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// Rotate() exchanges a refresh token for a new access and refresh token in
+// the same family. Each refresh token works once: presenting one that was
+// already used means it was stolen, so the whole family is revoked and
+// ErrTokenReused is returned. The old token is only spent if the new pair
+// is stored, so a failed rotation can be retried with it
+func (m TokenModel) Rotate(refreshPlaintext string, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	refreshHash := sha256.Sum256([]byte(refreshPlaintext))
+	query := `
+		UPDATE tokens
+		SET used_at = NOW()
+		WHERE hash = $1 AND scope = $2
+		AND used_at IS NULL AND expiry > $3
+		RETURNING user_id, family_id, user_agent
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	var userID int64
+	var familyID []byte
+	var userAgent string
+	err = tx.QueryRowContext(ctx, query, refreshHash[:], ScopeRefresh, time.Now()).Scan(&userID, &familyID, &userAgent)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, err
+		}
+		// Find out whether the token was already used
+		query = `
+			SELECT family_id
+			FROM tokens
+			WHERE hash = $1 AND scope = $2 AND used_at IS NOT NULL
+		`
+		err = tx.QueryRowContext(ctx, query, refreshHash[:], ScopeRefresh).Scan(&familyID)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return nil, nil, ErrRecordNotFound
+			default:
+				return nil, nil, err
+			}
+		}
+		// Replay detected, log every holder of the family out
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family_id = $1`, familyID)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrTokenReused
+	}
+	access, refresh, err := m.newSessionTokens(ctx, tx, userID, familyID, refreshHash[:], accessTTL, refreshTTL, userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// newSessionTokens() creates and inserts an access and refresh token pair
+// as part of the transaction
+func (m TokenModel) newSessionTokens(ctx context.Context, tx *sql.Tx, userID int64, familyID, parentHash []byte, accessTTL, refreshTTL time.Duration, userAgent string) (*Token, *Token, error) {
+	access, err := generateToken(userID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, token := range []*Token{access, refresh} {
+		token.UserAgent = userAgent
+		token.FamilyID = familyID
+		token.ParentHash = parentHash
+		err = insertToken(ctx, tx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return access, refresh, nil
+}
+
+// The execer interface is met by both *sql.DB and *sql.Tx, so that a token
+// can be inserted on its own or as part of a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
 // Insert will insert an entry into the tokens table
 func (m TokenModel) Insert(token *Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return insertToken(ctx, m.DB, token)
+}
+
+// The insertToken() function inserts a token with db
+func insertToken(ctx context.Context, db execer, token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, family_id, parent_hash, client_id, permissions)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	`
 	args := []interface{}{
 		token.Hash,
 		token.UserID,
 		token.Expiry,
 		token.Scope,
+		token.UserAgent,
+		token.FamilyID,
+		token.ParentHash,
+		sql.NullInt64{Int64: token.ClientID, Valid: token.ClientID != 0},
+		pq.Array(token.Permissions),
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	_, err := db.ExecContext(ctx, query, args...)
 	return err
 }
 
@@ -101,4 +271,226 @@ func (m TokenModel) DeleteAllForUsers(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 
 	return err
-}
\ No newline at end of file
+}
+
+// Consume() deletes the token of a scope matching a plaintext and returns the
+// ID of its user. Deleting and reading in one statement means that of two
+// concurrent attempts only one gets the token. An expired token is deleted
+// all the same but reported as not found
+func (m TokenModel) Consume(scope, tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2
+		RETURNING user_id, expiry > NOW()
+	`
+	var userID int64
+	var unexpired bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope).Scan(&userID, &unexpired)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	if !unexpired {
+		return 0, ErrRecordNotFound
+	}
+	return userID, nil
+}
+
+// CountCreatedSince() returns how many tokens of a scope were issued to a
+// user after the given time
+func (m TokenModel) CountCreatedSince(scope string, userID int64, since time.Time) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND created_at > $3
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, scope, userID, since).Scan(&count)
+	return count, err
+}
+
+// DeleteSession() revokes the token matching the hash together with the
+// rest of its family, so that the refresh token of a logged out session
+// cannot be used either
+func (m TokenModel) DeleteSession(tokenHash []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1
+		OR family_id = (SELECT family_id FROM tokens WHERE hash = $1)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+
+	return err
+}
+
+// DeleteAllSessionsForUser() revokes every access and refresh token of a user,
+// including the ones issued to OAuth clients
+func (m TokenModel) DeleteAllSessionsForUser(userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope IN ($1, $2, $3) AND user_id = $4
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, ScopeAuthentication, ScopeRefresh, ScopeOAuth, userID)
+
+	return err
+}
+
+// DeleteExpired() removes at most batchSize expired tokens and returns how
+// many were deleted. Keeping batches small avoids long locks on the table
+func (m TokenModel) DeleteExpired(batchSize int) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE hash IN (
+			SELECT hash FROM tokens
+			WHERE expiry < $1
+			LIMIT $2
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Touch() records that a token was just used. To save writes the time is
+// only updated when it is more than a minute old
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW()
+		WHERE hash = $1
+		AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+
+	return err
+}
+
+// GetSessionsForUser() lists the logins of a user that have not expired,
+// newest first, marking the one whose access token hashes to currentHash.
+// A session is a token family so it outlives the access tokens rotated
+// within it
+func (m TokenModel) GetSessionsForUser(userID int64, currentHash []byte) ([]*Session, error) {
+	query := `
+		SELECT MIN(created_at), MAX(GREATEST(last_used_at, used_at)), MAX(expiry),
+		MAX(user_agent), BOOL_OR(hash = $4)
+		FROM tokens
+		WHERE scope IN ($1, $2) AND user_id = $3 AND expiry > NOW()
+		GROUP BY COALESCE(family_id, hash)
+		ORDER BY MIN(created_at) DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, ScopeAuthentication, ScopeRefresh, userID, currentHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// IsOAuthToken() reports whether a bearer token was issued to an OAuth client
+func IsOAuthToken(tokenPlaintext string) bool {
+	return strings.HasPrefix(tokenPlaintext, OAuthTokenPrefix)
+}
+
+// NewOAuth() creates and inserts an access token for an OAuth client that
+// is limited to the granted scopes
+func (m TokenModel) NewOAuth(userID, clientID int64, scopes Permissions, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeOAuth)
+	if err != nil {
+		return nil, err
+	}
+	token.Plaintext = OAuthTokenPrefix + token.Plaintext
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+	token.ClientID = clientID
+	token.Permissions = scopes
+	err = m.Insert(token)
+	return token, err
+}
+
+// GetOAuth() returns the unexpired OAuth access token matching a plaintext
+func (m TokenModel) GetOAuth(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		SELECT user_id, expiry, client_id, permissions
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > NOW()
+	`
+	token := Token{Plaintext: tokenPlaintext, Hash: tokenHash[:], Scope: ScopeOAuth}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeOAuth).Scan(
+		&token.UserID,
+		&token.Expiry,
+		&token.ClientID,
+		pq.Array(&token.Permissions),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+// DeleteOAuth() revokes an access token issued to a client. Tokens of other
+// clients are left alone
+func (m TokenModel) DeleteOAuth(tokenPlaintext string, clientID int64) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND client_id = $3
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], ScopeOAuth, clientID)
+
+	return err
+}
@@ -15,20 +15,63 @@ import (
 
 var (
 	ErrDuplicateEmail = errors.New("duplicate email")
+	// The placeholder is inserted by a migration, so it missing means the
+	// database was set up by hand or the row was deleted
+	ErrNoPlaceholder = errors.New("the placeholder account for deleted users is missing")
 )
 
+// The email address of the placeholder account that takes over the posts,
+// comments and likes of deleted accounts
+const DeletedUserEmail = "deleted@users.invalid"
+
 // Declare an AnonymousUser, no id, no name, no email, no password
 var AnonymousUser = &User{}
 
+// The User type is the account as seen by its owner. It includes the email
+// address so it must never be sent to anyone else, see Profile
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID           int64      `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Username     string     `json:"username"`
+	DisplayName  string     `json:"display_name"`
+	Bio          string     `json:"bio"`
+	Email        string     `json:"email"`
+	PendingEmail string     `json:"pending_email,omitempty"`
+	Password     password   `json:"-"`
+	Activated    bool       `json:"activated"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	Version      int        `json:"-"`
+}
+
+// The Profile type is the public view of a user
+type Profile struct {
+	ID           int64     `json:"id"`
+	Username     string    `json:"username"`
+	DisplayName  string    `json:"display_name"`
+	Bio          string    `json:"bio"`
+	JoinedAt     time.Time `json:"joined_at"`
+	PostCount    int       `json:"post_count"`
+	CommentCount int       `json:"comment_count"`
+}
+// The Author type is the public summary of a user that is embedded
+// in the posts and comments they created
+type Author struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+// The newAuthor() function builds an Author from the nullable columns of a
+// LEFT JOIN on users. Records created before authorship was tracked have none
+func newAuthor(id sql.NullInt64, username sql.NullString) *Author {
+	if !id.Valid {
+		return nil
+	}
+	return &Author{
+		ID:       id.Int64,
+		Username: username.String,
+	}
 }
+
 // Check if a user is anonymous
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
@@ -66,6 +109,16 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	return true, nil
 }
 
+// A cost-12 bcrypt hash of a random password nobody knows. Checking a password
+// against it takes as long as checking a real one
+var dummyPasswordHash = []byte("$2a$12$BSD2epkj2Y9PKaqpjd5Ry.xriQCKO6PF2T/5y5UcWHtEDC0CcyuQ.")
+
+// CompareDummyPassword() does the work of a password check without checking
+// anything, so that logins for unknown emails are not answered any faster
+func CompareDummyPassword(plaintextPassword string) {
+	_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(plaintextPassword))
+}
+
 // Validate the client request
 func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
@@ -81,6 +134,8 @@ func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.Username != "", "username", "must be provided")
 	v.Check(len(user.Username) <= 500, "username", "must not be more than 500 bytes long")
+	v.Check(len(user.DisplayName) <= 100, "display_name", "must not be more than 100 bytes long")
+	v.Check(len(user.Bio) <= 1000, "bio", "must not be more than 1000 bytes long")
 	// validate the email
 	ValidateEmail(v, user.Email)
 	// validate the password
@@ -127,24 +182,71 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-// Get user based on their email
+// Get user based on their id
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, username, display_name, bio, email,
+		COALESCE(pending_email, ''), password_hash, activated, deleted_at, version
+		FROM users
+		WHERE id = $1
+	`
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Username,
+		&user.DisplayName,
+		&user.Bio,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.DeletedAt,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// Get user based on their email. The placeholder that purged accounts hand
+// their content to is never found, so nobody can log in as it or reset its
+// password
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, created_at, username, email, password_hash, activated, version
+		SELECT id, created_at, username, display_name, bio, email,
+		COALESCE(pending_email, ''), password_hash, activated, deleted_at, version
 		FROM users
 		WHERE email = $1
+		AND email <> $2
 	`
 	var user User
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+	err := m.DB.QueryRowContext(ctx, query, email, DeletedUserEmail).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Username,
+		&user.DisplayName,
+		&user.Bio,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.DeletedAt,
 		&user.Version,
 	)
 	if err != nil {
@@ -162,7 +264,9 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 func (m UserModel) Update(user *User) error {
 	query := `
 		UPDATE users
-		SET username = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
+		SET username = $1, email = $2, password_hash = $3, activated = $4,
+		display_name = $7, bio = $8, pending_email = NULLIF($9, ''), deleted_at = $10,
+		version = version + 1
 		WHERE id = $5 AND version = $6
 		RETURNING version
 	`
@@ -173,6 +277,10 @@ func (m UserModel) Update(user *User) error {
 		user.Activated,
 		user.ID,
 		user.Version,
+		user.DisplayName,
+		user.Bio,
+		user.PendingEmail,
+		user.DeletedAt,
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -181,6 +289,8 @@ func (m UserModel) Update(user *User) error {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
 		default:
 			return err
 		}
@@ -188,20 +298,61 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// GetProfile() returns the public profile of an activated user together with
+// the number of posts and comments they have written
+func (m UserModel) GetProfile(id int64) (*Profile, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, username, display_name, bio, created_at,
+		(SELECT COUNT(*) FROM posts WHERE posts.user_id = users.id),
+		(SELECT COUNT(*) FROM comments WHERE comments.user_id = users.id)
+		FROM users
+		WHERE id = $1 AND activated = true AND deleted_at IS NULL
+	`
+	var profile Profile
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&profile.ID,
+		&profile.Username,
+		&profile.DisplayName,
+		&profile.Bio,
+		&profile.JoinedAt,
+		&profile.PostCount,
+		&profile.CommentCount,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &profile, nil
+}
+
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// Setup query
 	query := `
-		SELECT users.id, users.created_at, users.username, users.email,
-		users.password_hash, users.activated, users.version
+		SELECT users.id, users.created_at, users.username, users.display_name, users.bio,
+		users.email, COALESCE(users.pending_email, ''),
+		users.password_hash, users.activated, users.deleted_at, users.version
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
 		WHERE tokens.hash = $1
 		AND tokens.scope = $2
 		AND tokens.expiry > $3
+		AND (users.deleted_at IS NULL OR tokens.scope = $4)
 	`
-	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+	// A deleted account can still finish the two-factor step of a login,
+	// which is what restores it during the grace period
+	args := []interface{}{tokenHash[:], tokenScope, time.Now(), ScopeTwoFactorPending}
 	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -210,9 +361,13 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.ID,
 		&user.CreatedAt,
 		&user.Username,
+		&user.DisplayName,
+		&user.Bio,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.DeletedAt,
 		&user.Version,
 	)
 	if err != nil {
@@ -224,4 +379,140 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		}
 	}
 	return &user, nil
-}
\ No newline at end of file
+}
+
+// DeleteUnactivatedBefore() removes the accounts that were registered before
+// the cutoff and never activated, freeing up their email addresses. The
+// placeholder of deleted accounts is never activated but has to stay
+func (m UserModel) DeleteUnactivatedBefore(cutoff time.Time) (int64, error) {
+	query := `
+		DELETE FROM users
+		WHERE activated = false AND created_at < $1 AND email <> $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, cutoff, DeletedUserEmail)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetDeletedBefore() returns the ids of the accounts that were deleted before
+// the cutoff and are due to be anonymized
+func (m UserModel) GetDeletedBefore(cutoff time.Time) ([]int64, error) {
+	query := `
+		SELECT id
+		FROM users
+		WHERE deleted_at < $1
+		ORDER BY id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Anonymize() removes an account for good. Its posts, comments and likes are
+// handed over to the placeholder account so that threads and like counts stay
+// intact, while tokens, roles and permissions go with the user. The paths of
+// the user's export archives are returned so the caller can remove the files
+func (m UserModel) Anonymize(id int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	var placeholderID int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE email = $1`, DeletedUserEmail).Scan(&placeholderID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoPlaceholder
+		default:
+			return nil, err
+		}
+	}
+	if id < 1 || id == placeholderID {
+		return nil, ErrRecordNotFound
+	}
+	// A like the placeholder already has cannot be handed over again, so
+	// it is kept without an owner instead
+	queries := []string{
+		`UPDATE posts SET user_id = $2 WHERE user_id = $1`,
+		`UPDATE comments SET user_id = $2 WHERE user_id = $1`,
+		`UPDATE likedpost SET users_id = CASE
+			WHEN EXISTS (SELECT 1 FROM likedpost taken WHERE taken.users_id = $2 AND taken.posts_id = likedpost.posts_id)
+			THEN NULL ELSE $2::bigint END
+		WHERE users_id = $1`,
+		`UPDATE likedcomment SET users_id = CASE
+			WHEN EXISTS (SELECT 1 FROM likedcomment taken WHERE taken.users_id = $2 AND taken.comments_id = likedcomment.comments_id)
+			THEN NULL ELSE $2::bigint END
+		WHERE users_id = $1`,
+	}
+	for _, query := range queries {
+		_, err = tx.ExecContext(ctx, query, id, placeholderID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The exports would go with the user, so their paths are collected first
+	rows, err := tx.QueryContext(ctx, `DELETE FROM exports WHERE user_id = $1 RETURNING path`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	paths := []string{}
+	for rows.Next() {
+		var path string
+		err := rows.Scan(&path)
+		if err != nil {
+			return nil, err
+		}
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrRecordNotFound
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
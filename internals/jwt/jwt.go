@@ -0,0 +1,172 @@
+// Filename: internal/jwt/jwt.go
+
+// Package jwt signs and verifies the stateless access tokens the API can
+// issue instead of database tokens. They are JSON Web Tokens signed with
+// HMAC-SHA256, and the kid header names the key that signed them so that
+// keys can be rotated without logging everybody out
+package jwt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MinSecretLength is the shortest secret accepted for a key, in bytes
+const MinSecretLength = 32
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+)
+
+// The Claims type holds what a token says about the user it was issued to
+type Claims struct {
+	Subject     int64    `json:"sub"`
+	Activated   bool     `json:"act"`
+	Permissions []string `json:"perms"`
+	SessionID   string   `json:"sid,omitempty"`
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// The Keys type holds the keys tokens are verified with, and the ID of the
+// one new tokens are signed with. During a rotation the new key signs while
+// the old one is kept until the tokens it signed have expired
+type Keys struct {
+	secrets   map[string][]byte
+	signingID string
+}
+
+// NewKeys() returns an empty key set
+func NewKeys() *Keys {
+	return &Keys{secrets: make(map[string][]byte)}
+}
+
+// Add() adds a verification key. The first key added signs new tokens
+// unless SetSigningKey() picks another one
+func (k *Keys) Add(id string, secret []byte) error {
+	if id == "" {
+		return errors.New("key ID must be provided")
+	}
+	if len(secret) < MinSecretLength {
+		return fmt.Errorf("key %q must be at least %d bytes long", id, MinSecretLength)
+	}
+	if _, exists := k.secrets[id]; exists {
+		return fmt.Errorf("duplicate key ID %q", id)
+	}
+	k.secrets[id] = secret
+	if k.signingID == "" {
+		k.signingID = id
+	}
+	return nil
+}
+
+// Set() parses a key in the "id:secret" form used on the command line
+func (k *Keys) Set(value string) error {
+	id, secret, found := strings.Cut(value, ":")
+	if !found {
+		return errors.New(`key must be in the form "id:secret"`)
+	}
+	return k.Add(id, []byte(secret))
+}
+
+// SetSigningKey() picks the key new tokens are signed with
+func (k *Keys) SetSigningKey(id string) error {
+	if _, exists := k.secrets[id]; !exists {
+		return fmt.Errorf("unknown key ID %q", id)
+	}
+	k.signingID = id
+	return nil
+}
+
+// Len() returns the number of keys
+func (k *Keys) Len() int {
+	return len(k.secrets)
+}
+
+// IsJWT() reports whether a bearer token looks like a JSON Web Token rather
+// than an opaque token
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Sign() returns a token carrying the claims, signed with the signing key
+func (k *Keys) Sign(claims Claims) (string, error) {
+	secret, ok := k.secrets[k.signingID]
+	if !ok {
+		return "", errors.New("no signing key configured")
+	}
+	h, err := json.Marshal(header{Algorithm: "HS256", Type: "JWT", KeyID: k.signingID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	return unsigned + "." + encoding.EncodeToString(sign(secret, unsigned)), nil
+}
+
+// Verify() checks the signature and expiry of a token and returns its
+// claims. Tokens signed with a key that is no longer configured, or with any
+// algorithm but HS256, are invalid
+func (k *Keys) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	err := decode(parts[0], &h)
+	if err != nil || h.Algorithm != "HS256" {
+		return nil, ErrInvalidToken
+	}
+	secret, ok := k.secrets[h.KeyID]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal(signature, sign(secret, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	err = decode(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+func sign(secret []byte, unsigned string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
+
+func decode(segment string, dst interface{}) error {
+	js, err := encoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, dst)
+}
@@ -0,0 +1,206 @@
+// Filename: internal/jwt/jwt_test.go
+
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	oldSecret = []byte(strings.Repeat("o", MinSecretLength))
+	newSecret = []byte(strings.Repeat("n", MinSecretLength))
+)
+
+// newTestKeys() returns a key set with the keys in the order given, the
+// first one signing
+func newTestKeys(t *testing.T, ids ...string) *Keys {
+	t.Helper()
+	secrets := map[string][]byte{"old": oldSecret, "new": newSecret}
+	keys := NewKeys()
+	for _, id := range ids {
+		err := keys.Add(id, secrets[id])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+// forge() builds a token with any header, signed with secret
+func forge(t *testing.T, h interface{}, claims Claims, secret []byte) string {
+	t.Helper()
+	hs, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := encoding.EncodeToString(hs) + "." + encoding.EncodeToString(cs)
+	return unsigned + "." + encoding.EncodeToString(sign(secret, unsigned))
+}
+
+// unsigned() strips the signature off a token, leaving the trailing dot
+func unsigned(token string) string {
+	return token[:strings.LastIndex(token, ".")+1]
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	claims := Claims{
+		Subject:     42,
+		Activated:   true,
+		Permissions: []string{"forums:read"},
+		SessionID:   "session",
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   now.Add(15 * time.Minute).Unix(),
+	}
+	keys := newTestKeys(t, "old")
+	valid, err := keys.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ".")
+	other := claims
+	other.Subject = 1
+	tampered := forge(t, header{"HS256", "JWT", "old"}, other, oldSecret)
+
+	tests := []struct {
+		name    string
+		token   string
+		now     time.Time
+		wantErr error
+	}{
+		{"valid", valid, now, nil},
+		{"one second before expiry", valid, now.Add(15*time.Minute - time.Second), nil},
+		{"at expiry", valid, now.Add(15 * time.Minute), ErrExpiredToken},
+		{"after expiry", valid, now.Add(time.Hour), ErrExpiredToken},
+		{"alg none", unsigned(forge(t, header{"none", "JWT", "old"}, claims, oldSecret)), now, ErrInvalidToken},
+		{"alg none signed", forge(t, header{"none", "JWT", "old"}, claims, oldSecret), now, ErrInvalidToken},
+		{"alg HS512", forge(t, header{"HS512", "JWT", "old"}, claims, oldSecret), now, ErrInvalidToken},
+		{"alg RS256", forge(t, header{"RS256", "JWT", "old"}, claims, oldSecret), now, ErrInvalidToken},
+		{"alg lower case", forge(t, header{"hs256", "JWT", "old"}, claims, oldSecret), now, ErrInvalidToken},
+		{"no alg", forge(t, map[string]string{"kid": "old"}, claims, oldSecret), now, ErrInvalidToken},
+		{"wrong secret", forge(t, header{"HS256", "JWT", "old"}, claims, newSecret), now, ErrInvalidToken},
+		{"claims changed", parts[0] + "." + strings.Split(tampered, ".")[1] + "." + parts[2], now, ErrInvalidToken},
+		{"signature changed", parts[0] + "." + parts[1] + "." + strings.Split(tampered, ".")[2], now, ErrInvalidToken},
+		{"signature missing", unsigned(valid), now, ErrInvalidToken},
+		{"unknown kid", forge(t, header{"HS256", "JWT", "new"}, claims, newSecret), now, ErrInvalidToken},
+		{"no kid", forge(t, header{Algorithm: "HS256", Type: "JWT"}, claims, oldSecret), now, ErrInvalidToken},
+		{"two segments", parts[0] + "." + parts[1], now, ErrInvalidToken},
+		{"four segments", valid + "." + parts[2], now, ErrInvalidToken},
+		{"header not base64", "!!!." + parts[1] + "." + parts[2], now, ErrInvalidToken},
+		{"opaque token", "AAAAAAAAAAAAAAAAAAAAAAAAAA", now, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keys.Verify(tt.token, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Subject != claims.Subject || got.SessionID != claims.SessionID || got.ExpiresAt != claims.ExpiresAt {
+				t.Fatalf("got claims %+v; want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+	claims := Claims{Subject: 42, ExpiresAt: now.Add(time.Hour).Unix()}
+
+	// Before the rotation the old key signs
+	before := newTestKeys(t, "old")
+	signedByOld, err := before.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// During the rotation the new key signs and the old one still verifies
+	during := newTestKeys(t, "old", "new")
+	err = during.SetSigningKey("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedByNew, err := during.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// After the rotation the old key is gone
+	after := newTestKeys(t, "new")
+
+	var h header
+	err = decode(strings.Split(signedByNew, ".")[0], &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.KeyID != "new" {
+		t.Fatalf("got kid %q; want %q", h.KeyID, "new")
+	}
+
+	tests := []struct {
+		name    string
+		keys    *Keys
+		token   string
+		wantErr error
+	}{
+		{"old token before", before, signedByOld, nil},
+		{"new token before", before, signedByNew, ErrInvalidToken},
+		{"old token during", during, signedByOld, nil},
+		{"new token during", during, signedByNew, nil},
+		{"old token after", after, signedByOld, ErrInvalidToken},
+		{"new token after", after, signedByNew, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.keys.Verify(tt.token, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeysSet(t *testing.T) {
+	secret := strings.Repeat("s", MinSecretLength)
+	tests := []struct {
+		name    string
+		values  []string
+		wantErr bool
+	}{
+		{"one key", []string{"a:" + secret}, false},
+		{"two keys", []string{"a:" + secret, "b:" + secret}, false},
+		{"colon in secret", []string{"a:" + secret + ":more"}, false},
+		{"no colon", []string{"a" + secret}, true},
+		{"no id", []string{":" + secret}, true},
+		{"short secret", []string{"a:" + secret[1:]}, true},
+		{"duplicate id", []string{"a:" + secret, "a:" + secret}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := NewKeys()
+			var err error
+			for _, value := range tt.values {
+				if err = keys.Set(value); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+	if err := NewKeys().SetSigningKey("a"); err == nil {
+		t.Fatal("SetSigningKey() accepted an unknown key")
+	}
+	if _, err := NewKeys().Sign(Claims{}); err == nil {
+		t.Fatal("Sign() worked without a key")
+	}
+}
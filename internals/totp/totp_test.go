@@ -0,0 +1,98 @@
+// Filename: internal/totp/totp_test.go
+
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 secret of the RFC 6238 test vectors, "12345678901234567890"
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B. The vectors have 8 digits, the last 6 of them
+	// are the 6 digit code
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.want[len(tt.want)-Digits:]; got != want {
+				t.Fatalf("got %s; want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code := "050471"
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		at       time.Time
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", rfcSecret, code, now, Step(now), true},
+		{"one step behind", rfcSecret, code, now.Add(Period * time.Second), Step(now), true},
+		{"one step ahead", rfcSecret, code, now.Add(-Period * time.Second), Step(now), true},
+		{"two steps behind", rfcSecret, code, now.Add(2 * Period * time.Second), 0, false},
+		{"two steps ahead", rfcSecret, code, now.Add(-2 * Period * time.Second), 0, false},
+		{"surrounding spaces", rfcSecret, " " + code + " ", now, Step(now), true},
+		{"lower case secret", strings.ToLower(rfcSecret), code, now, Step(now), true},
+		{"wrong code", rfcSecret, "050472", now, 0, false},
+		{"short code", rfcSecret, code[1:], now, 0, false},
+		{"long code", rfcSecret, code + "1", now, 0, false},
+		{"empty code", rfcSecret, "", now, 0, false},
+		{"invalid secret", "not base32!", code, now, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(tt.secret, tt.code, tt.at)
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %t; want %t", ok, tt.wantOK)
+			}
+			if step != tt.wantStep {
+				t.Fatalf("got step %d; want %d", step, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 20 {
+		t.Fatalf("got a %d byte secret; want 20 bytes", len(key))
+	}
+	code, err := Code(secret, Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(secret, code, time.Now()); !ok {
+		t.Fatal("the code of a new secret is not valid")
+	}
+}
@@ -0,0 +1,11 @@
+-- Filename: migrations/000009_add_comments_post_id.down.sql
+
+DROP INDEX IF EXISTS comments_post_id_idx;
+ALTER TABLE comments DROP COLUMN IF EXISTS post_id;
+
+ALTER TABLE likedcomment DROP CONSTRAINT IF EXISTS likedcomment_comments_id_fkey;
+ALTER TABLE likedcomment ADD CONSTRAINT likedcomment_comments_id_fkey
+    FOREIGN KEY (comments_id) REFERENCES comments (id);
+ALTER TABLE likedpost DROP CONSTRAINT IF EXISTS likedpost_posts_id_fkey;
+ALTER TABLE likedpost ADD CONSTRAINT likedpost_posts_id_fkey
+    FOREIGN KEY (posts_id) REFERENCES posts (id);
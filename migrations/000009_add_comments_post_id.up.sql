@@ -0,0 +1,15 @@
+-- Filename: migrations/000009_add_comments_post_id.up.sql
+
+-- Likes must go away together with the post or comment they point at
+ALTER TABLE likedpost DROP CONSTRAINT IF EXISTS likedpost_posts_id_fkey;
+ALTER TABLE likedpost ADD CONSTRAINT likedpost_posts_id_fkey
+    FOREIGN KEY (posts_id) REFERENCES posts (id) ON DELETE CASCADE;
+ALTER TABLE likedcomment DROP CONSTRAINT IF EXISTS likedcomment_comments_id_fkey;
+ALTER TABLE likedcomment ADD CONSTRAINT likedcomment_comments_id_fkey
+    FOREIGN KEY (comments_id) REFERENCES comments (id) ON DELETE CASCADE;
+
+-- Comments created before this migration were never tied to a post, so
+-- there is no thread we can attach them to. The column stays nullable and
+-- they are kept without one, while every new comment gets a post
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS post_id bigint REFERENCES posts (id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS comments_post_id_idx ON comments (post_id);
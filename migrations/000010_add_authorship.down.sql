@@ -0,0 +1,9 @@
+-- Filename: migrations/000010_add_authorship.down.sql
+
+DELETE FROM permissions WHERE code = 'forums:moderate';
+
+DROP INDEX IF EXISTS comments_user_id_idx;
+DROP INDEX IF EXISTS posts_user_id_idx;
+
+ALTER TABLE comments DROP COLUMN IF EXISTS user_id;
+ALTER TABLE posts DROP COLUMN IF EXISTS user_id;
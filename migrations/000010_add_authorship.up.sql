@@ -0,0 +1,11 @@
+-- Filename: migrations/000010_add_authorship.up.sql
+
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users (id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS posts_user_id_idx ON posts (user_id);
+CREATE INDEX IF NOT EXISTS comments_user_id_idx ON comments (user_id);
+
+-- moderators may edit and delete content they do not own
+INSERT INTO permissions (code)
+VALUES ('forums:moderate');
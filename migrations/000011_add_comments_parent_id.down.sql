@@ -0,0 +1,4 @@
+-- Filename: migrations/000011_add_comments_parent_id.down.sql
+
+DROP INDEX IF EXISTS comments_parent_id_idx;
+ALTER TABLE comments DROP COLUMN IF EXISTS parent_id;
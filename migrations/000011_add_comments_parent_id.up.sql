@@ -0,0 +1,4 @@
+-- Filename: migrations/000011_add_comments_parent_id.up.sql
+
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS parent_id bigint REFERENCES comments (id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS comments_parent_id_idx ON comments (parent_id);
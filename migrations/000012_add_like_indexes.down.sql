@@ -0,0 +1,4 @@
+-- Filename: migrations/000012_add_like_indexes.down.sql
+
+DROP INDEX IF EXISTS likedcomment_comments_id_idx;
+DROP INDEX IF EXISTS likedpost_posts_id_idx;
@@ -0,0 +1,6 @@
+-- Filename: migrations/000012_add_like_indexes.up.sql
+
+-- The unique constraints lead with users_id so counting the likes of a
+-- post or comment needs its own index
+CREATE INDEX IF NOT EXISTS likedpost_posts_id_idx ON likedpost (posts_id);
+CREATE INDEX IF NOT EXISTS likedcomment_comments_id_idx ON likedcomment (comments_id);
@@ -0,0 +1,10 @@
+-- Filename: migrations/000013_add_post_ranking.down.sql
+
+DROP INDEX IF EXISTS posts_created_at_idx;
+DROP INDEX IF EXISTS posts_last_activity_at_idx;
+DROP INDEX IF EXISTS posts_like_count_idx;
+DROP INDEX IF EXISTS posts_hot_score_idx;
+
+ALTER TABLE posts DROP COLUMN IF EXISTS last_activity_at;
+ALTER TABLE posts DROP COLUMN IF EXISTS hot_score;
+ALTER TABLE posts DROP COLUMN IF EXISTS like_count;
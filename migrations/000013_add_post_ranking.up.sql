@@ -0,0 +1,20 @@
+-- Filename: migrations/000013_add_post_ranking.up.sql
+
+-- like_count and hot_score are kept up to date by the application so that
+-- the ranked listings can be read straight off an index
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS like_count integer NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS hot_score double precision NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS last_activity_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+
+UPDATE posts SET like_count = (SELECT COUNT(*) FROM likedpost WHERE likedpost.posts_id = posts.id);
+UPDATE posts SET hot_score = LOG(GREATEST(like_count, 1)) + EXTRACT(EPOCH FROM created_at) / 45000;
+UPDATE posts SET last_activity_at = GREATEST(
+    created_at,
+    (SELECT MAX(created_at) FROM comments WHERE comments.post_id = posts.id),
+    (SELECT MAX(created_at) FROM likedpost WHERE likedpost.posts_id = posts.id)
+);
+
+CREATE INDEX IF NOT EXISTS posts_hot_score_idx ON posts (hot_score DESC, id DESC);
+CREATE INDEX IF NOT EXISTS posts_like_count_idx ON posts (like_count DESC, id DESC);
+CREATE INDEX IF NOT EXISTS posts_last_activity_at_idx ON posts (last_activity_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS posts_created_at_idx ON posts (created_at DESC, id DESC);
@@ -0,0 +1,4 @@
+-- Filename: migrations/000014_add_tokens_created_at.down.sql
+
+DROP INDEX IF EXISTS tokens_user_id_scope_idx;
+ALTER TABLE tokens DROP COLUMN IF EXISTS created_at;
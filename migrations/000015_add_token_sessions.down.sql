@@ -0,0 +1,4 @@
+-- Filename: migrations/000015_add_token_sessions.down.sql
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE tokens DROP COLUMN IF EXISTS last_used_at;
@@ -0,0 +1,4 @@
+-- Filename: migrations/000015_add_token_sessions.up.sql
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) with time zone;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
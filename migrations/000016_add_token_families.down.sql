@@ -0,0 +1,6 @@
+-- Filename: migrations/000016_add_token_families.down.sql
+
+DROP INDEX IF EXISTS tokens_family_id_idx;
+ALTER TABLE tokens DROP COLUMN IF EXISTS used_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS parent_hash;
+ALTER TABLE tokens DROP COLUMN IF EXISTS family_id;
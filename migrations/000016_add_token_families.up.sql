@@ -0,0 +1,8 @@
+-- Filename: migrations/000016_add_token_families.up.sql
+
+-- Every login starts a family of access and refresh tokens. Rotating a
+-- refresh token marks it as used and links the new one to it
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family_id bytea;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS parent_hash bytea;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS tokens_family_id_idx ON tokens (family_id);
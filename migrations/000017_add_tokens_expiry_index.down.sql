@@ -0,0 +1,3 @@
+-- Filename: migrations/000017_add_tokens_expiry_index.down.sql
+
+DROP INDEX IF EXISTS tokens_expiry_idx;
@@ -0,0 +1,3 @@
+-- Filename: migrations/000017_add_tokens_expiry_index.up.sql
+
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
@@ -0,0 +1,8 @@
+-- Filename: migrations/000018_add_roles.down.sql
+
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
+
+DELETE FROM permissions WHERE code = 'users:admin';
+ALTER TABLE permissions DROP CONSTRAINT IF EXISTS permissions_code_key;
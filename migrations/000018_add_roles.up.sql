@@ -0,0 +1,39 @@
+-- Filename: migrations/000018_add_roles.up.sql
+
+ALTER TABLE permissions ADD CONSTRAINT permissions_code_key UNIQUE (code);
+
+INSERT INTO permissions (code)
+VALUES ('users:admin')
+ON CONFLICT (code) DO NOTHING;
+
+-- a role is a named bundle of permissions
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY(role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    PRIMARY KEY(user_id, role_id)
+);
+
+INSERT INTO roles (name)
+VALUES ('member'), ('moderator'), ('admin');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'member' AND permissions.code IN ('forums:read', 'forums:write'))
+OR (roles.name = 'moderator' AND permissions.code IN ('forums:read', 'forums:write', 'forums:moderate'))
+OR roles.name = 'admin';
+
+-- every registered user is a member
+INSERT INTO user_roles
+SELECT users.id, roles.id FROM users, roles WHERE roles.name = 'member';
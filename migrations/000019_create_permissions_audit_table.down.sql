@@ -0,0 +1,3 @@
+-- Filename: migrations/000019_create_permissions_audit_table.down.sql
+
+DROP TABLE IF EXISTS permissions_audit;
@@ -0,0 +1,12 @@
+-- Filename: migrations/000019_create_permissions_audit_table.up.sql
+
+CREATE TABLE IF NOT EXISTS permissions_audit (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    actor_id bigint REFERENCES users (id) ON DELETE SET NULL,
+    user_id bigint REFERENCES users (id) ON DELETE SET NULL,
+    code text NOT NULL,
+    action text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS permissions_audit_user_id_idx ON permissions_audit (user_id);
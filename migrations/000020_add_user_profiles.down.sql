@@ -0,0 +1,4 @@
+-- Filename: migrations/000020_add_user_profiles.down.sql
+
+ALTER TABLE users DROP COLUMN IF EXISTS bio;
+ALTER TABLE users DROP COLUMN IF EXISTS display_name;
@@ -0,0 +1,4 @@
+-- Filename: migrations/000020_add_user_profiles.up.sql
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bio text NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- Filename: migrations/000021_add_users_pending_email.down.sql
+
+ALTER TABLE users DROP COLUMN IF EXISTS pending_email;
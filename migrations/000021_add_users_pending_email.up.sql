@@ -0,0 +1,4 @@
+-- Filename: migrations/000021_add_users_pending_email.up.sql
+
+-- the address a user asked to change to, until they confirm it
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email citext;
@@ -0,0 +1,10 @@
+-- Filename: migrations/000022_add_account_deletion.down.sql
+
+UPDATE likedpost SET users_id = NULL
+WHERE users_id = (SELECT id FROM users WHERE email = 'deleted@users.invalid');
+UPDATE likedcomment SET users_id = NULL
+WHERE users_id = (SELECT id FROM users WHERE email = 'deleted@users.invalid');
+DELETE FROM users WHERE email = 'deleted@users.invalid';
+
+DROP INDEX IF EXISTS users_deleted_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,13 @@
+-- Filename: migrations/000022_add_account_deletion.up.sql
+
+-- set when a user deletes their account, it is purged after the grace period
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- the posts, comments and likes of purged accounts are handed over to this
+-- placeholder. Its password hash is not a bcrypt hash, so no password can
+-- ever match it, and it is never activated
+INSERT INTO users (username, email, password_hash, activated)
+VALUES ('deleted', 'deleted@users.invalid', convert_to('!', 'UTF8'), false)
+ON CONFLICT (email) DO NOTHING;
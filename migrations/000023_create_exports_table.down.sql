@@ -0,0 +1,3 @@
+-- Filename: migrations/000023_create_exports_table.down.sql
+
+DROP TABLE IF EXISTS exports;
@@ -0,0 +1,15 @@
+-- Filename: migrations/000023_create_exports_table.up.sql
+
+-- personal data exports, built in the background by the api
+CREATE TABLE IF NOT EXISTS exports (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    status text NOT NULL DEFAULT 'pending',
+    started_at timestamp(0) with time zone,
+    completed_at timestamp(0) with time zone,
+    path text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS exports_user_id_idx ON exports (user_id);
+CREATE INDEX IF NOT EXISTS exports_status_idx ON exports (status);
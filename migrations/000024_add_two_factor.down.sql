@@ -0,0 +1,4 @@
+-- Filename: migrations/000024_add_two_factor.down.sql
+
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS user_totp;
@@ -0,0 +1,3 @@
+-- Filename: migrations/000025_create_login_throttles_table.down.sql
+
+DROP TABLE IF EXISTS login_throttles;
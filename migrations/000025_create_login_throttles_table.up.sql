@@ -0,0 +1,9 @@
+-- Filename: migrations/000025_create_login_throttles_table.up.sql
+
+-- failed logins per account ('email:...') and per client ('ip:...')
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key text PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    blocked_until timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+-- Filename: migrations/000026_create_api_tokens_table.down.sql
+
+DROP TABLE IF EXISTS api_tokens;
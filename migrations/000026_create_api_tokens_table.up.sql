@@ -0,0 +1,16 @@
+-- Filename: migrations/000026_create_api_tokens_table.up.sql
+
+-- personal access tokens for bots and integrations. They can only use the
+-- permissions listed in permissions, and only while the user still has them
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    hash bytea UNIQUE NOT NULL,
+    label text NOT NULL,
+    permissions text[] NOT NULL,
+    expiry timestamp(0) with time zone,
+    last_used_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS api_tokens_user_id_idx ON api_tokens (user_id);
@@ -0,0 +1,7 @@
+-- Filename: migrations/000027_create_oauth_tables.down.sql
+
+DELETE FROM tokens WHERE client_id IS NOT NULL;
+ALTER TABLE tokens DROP COLUMN IF EXISTS permissions;
+ALTER TABLE tokens DROP COLUMN IF EXISTS client_id;
+DROP TABLE IF EXISTS oauth_codes;
+DROP TABLE IF EXISTS oauth_clients;
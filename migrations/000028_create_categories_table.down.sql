@@ -0,0 +1,4 @@
+-- Filename: migrations/000028_create_categories_table.down.sql
+
+ALTER TABLE posts DROP COLUMN IF EXISTS category_id;
+DROP TABLE IF EXISTS categories;
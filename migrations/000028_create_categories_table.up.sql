@@ -0,0 +1,20 @@
+-- Filename: migrations/000028_create_categories_table.up.sql
+
+-- categories (boards) group posts. A category can sit under a parent, and
+-- position orders the categories that share a parent
+CREATE TABLE IF NOT EXISTS categories (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    slug text UNIQUE NOT NULL,
+    description text NOT NULL DEFAULT '',
+    position integer NOT NULL DEFAULT 0,
+    parent_id bigint REFERENCES categories (id) ON DELETE SET NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories (parent_id, position);
+
+-- posts outside any category stay where they are
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS category_id bigint REFERENCES categories (id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS posts_category_id_idx ON posts (category_id);
@@ -0,0 +1,4 @@
+-- Filename: migrations/000029_create_tags_tables.down.sql
+
+DROP TABLE IF EXISTS posts_tags;
+DROP TABLE IF EXISTS tags;
@@ -0,0 +1,18 @@
+-- Filename: migrations/000029_create_tags_tables.up.sql
+
+-- tags are stored normalized, so "Go" and "go" are the same tag
+CREATE TABLE IF NOT EXISTS tags (
+    id bigserial PRIMARY KEY,
+    name text UNIQUE NOT NULL
+);
+
+-- the prefix searches of the autocomplete use this index
+CREATE INDEX IF NOT EXISTS tags_name_pattern_idx ON tags (name text_pattern_ops);
+
+CREATE TABLE IF NOT EXISTS posts_tags (
+    post_id bigint NOT NULL REFERENCES posts (id) ON DELETE CASCADE,
+    tag_id bigint NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    PRIMARY KEY (post_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS posts_tags_tag_id_idx ON posts_tags (tag_id);
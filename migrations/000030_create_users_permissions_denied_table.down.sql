@@ -0,0 +1,3 @@
+-- Filename: migrations/000030_create_users_permissions_denied_table.down.sql
+
+DROP TABLE IF EXISTS users_permissions_denied;
@@ -0,0 +1,9 @@
+-- Filename: migrations/000030_create_users_permissions_denied_table.up.sql
+
+-- permissions taken away from a user although one of their roles grants
+-- them, for example forums:write of a muted member
+CREATE TABLE IF NOT EXISTS users_permissions_denied (
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, permission_id)
+);